@@ -74,6 +74,8 @@ func main() {
 	var namespaces string
 	var selectors selectorsFlag
 	var dynamicDir string
+	var podLabels string
+	var peers bool
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -84,6 +86,9 @@ func main() {
 	flag.StringVar(&namespaces, "namespaces", "", "The namespaces to watch")
 	flag.Var(&selectors, "selectors", "list of selectors")
 	flag.StringVar(&dynamicDir, "dynamic-dir", "/var/run/iftop-exporter/dynamic", "The iftop-exporter dynamic dir to store interface info.")
+	flag.StringVar(&podLabels, "pod-labels", "", "The comma separated keys of the pod labels to write into interface info.")
+	flag.BoolVar(&peers, "peers", false,
+		"Write the index of the IPs of the pods and the services into the peer index file of the dynamic dir.")
 
 	opts := zap.Options{
 		Development: true,
@@ -136,6 +141,14 @@ func main() {
 		}
 	}
 
+	var podLabelList []string
+	for _, key := range strings.Split(podLabels, ",") {
+		_key := strings.TrimSpace(key)
+		if _key != "" {
+			podLabelList = append(podLabelList, _key)
+		}
+	}
+
 	defaultNamespaces := make(map[string]cache.Config)
 	if len(namespaceList) == 0 {
 		// cluster-level
@@ -181,10 +194,20 @@ func main() {
 		Rootfs:     rootfs,
 		Selectors:  ss,
 		DynamicDir: dynamicDir,
+		PodLabels:  podLabelList,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Pod")
 		os.Exit(1)
 	}
+	if peers {
+		if err = (&controller.PeerIndexReconciler{
+			Client:     mgr.GetClient(),
+			DynamicDir: dynamicDir,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "PeerIndex")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
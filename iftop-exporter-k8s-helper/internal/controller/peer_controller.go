@@ -0,0 +1,109 @@
+/*
+Copyright 2024 Bougou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter-k8s-helper/internal/utils"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// PeerIndexFile is the name of the peer index file in the dynamic dir, it is hidden so it is not taken as an interface file.
+const PeerIndexFile = ".peers.json"
+
+// peerIndexRequest is the only request of the PeerIndexReconciler, all events are coalesced into it.
+var peerIndexRequest = reconcile.Request{NamespacedName: types.NamespacedName{Name: "peer-index"}}
+
+// PeerIndexReconciler writes the index of the IPs of the pods and the services into the peer index file,
+// which iftop-exporter uses to resolve the peers of the flows, see utils.BuildPeerIndex.
+type PeerIndexReconciler struct {
+	client.Client
+
+	DynamicDir string
+
+	// written is the content of the latest written file, the file is only rewritten when it changes.
+	written []byte
+}
+
+//+kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+
+// Reconcile rebuilds the whole index from the cache, the events in the meantime are handled by a single run.
+func (r *PeerIndexReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods); err != nil {
+		return ctrl.Result{}, fmt.Errorf("list pods failed, err: %s", err)
+	}
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services); err != nil {
+		return ctrl.Result{}, fmt.Errorf("list services failed, err: %s", err)
+	}
+	endpointSlices := &discoveryv1.EndpointSliceList{}
+	if err := r.List(ctx, endpointSlices); err != nil {
+		return ctrl.Result{}, fmt.Errorf("list endpointslices failed, err: %s", err)
+	}
+
+	index := utils.BuildPeerIndex(pods.Items, services.Items, endpointSlices.Items)
+	v, err := json.Marshal(index)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("peer index json marshal failed, err: %s", err)
+	}
+	v = append(v, '\n')
+
+	if bytes.Equal(v, r.written) {
+		return ctrl.Result{}, nil
+	}
+
+	fileName := filepath.Join(r.DynamicDir, PeerIndexFile)
+	if err := utils.WriteFileAtomic(fileName, v, os.ModePerm); err != nil {
+		return ctrl.Result{}, fmt.Errorf("write peer index file (%s) failed: %s", fileName, err)
+	}
+	r.written = v
+	log.V(1).Info(fmt.Sprintf("write peer index file (%s) succeeded, (%d) peers", fileName, len(index.Peers)))
+
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PeerIndexReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	toIndex := handler.EnqueueRequestsFromMapFunc(func(context.Context, client.Object) []reconcile.Request {
+		return []reconcile.Request{peerIndexRequest}
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("peerindex").
+		Watches(&corev1.Pod{}, toIndex).
+		Watches(&corev1.Service{}, toIndex).
+		Watches(&discoveryv1.EndpointSlice{}, toIndex).
+		Complete(r)
+}
@@ -46,6 +46,8 @@ type PodReconciler struct {
 	Rootfs     string
 	Selectors  utils.Selectors
 	DynamicDir string
+	// PodLabels are the keys of the pod labels copied into the interface info.
+	PodLabels []string
 }
 
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;update;patch;delete
@@ -131,10 +133,24 @@ func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Complete(r)
 }
 
+// InterfaceInfoVersion is the version of the interface info file understood by iftop-exporter.
+const InterfaceInfoVersion = 1
+
+// CaptureAnnotation is the pod annotation holding the capture options (a JSON object) of the pod interfaces,
+// e.g. {"show_port": true, "sort_by": "10s"}, it is copied into the "capture" of the interface info file.
+const CaptureAnnotation = "iftop-exporter/capture"
+
 type InterfaceInfo struct {
-	Owner                  string `json:"owner,omitempty"`
-	ContainerInterfaceName string `json:"container_interface_name,omitempty"`
-	NodeInterfaceName      string `json:"node_interface_name,omitempty"`
+	Version                int               `json:"version"`
+	Owner                  string            `json:"owner,omitempty"`
+	ContainerInterfaceName string            `json:"container_interface_name,omitempty"`
+	NodeInterfaceName      string            `json:"node_interface_name,omitempty"`
+	Namespace              string            `json:"namespace,omitempty"`
+	Pod                    string            `json:"pod,omitempty"`
+	WorkloadKind           string            `json:"workload_kind,omitempty"`
+	Workload               string            `json:"workload,omitempty"`
+	Labels                 map[string]string `json:"labels,omitempty"`
+	Capture                json.RawMessage   `json:"capture,omitempty"`
 }
 
 func podKeyFromReq(req ctrl.Request) string {
@@ -167,11 +183,41 @@ func (r *PodReconciler) setInterfaces(ctx context.Context, podKey string, pod *c
 	if err != nil {
 		return fmt.Errorf("pod (%s) get container interfaces node mapping (%s) failed: %s", podKey, containerID, err)
 	}
+	workloadKind, workload := utils.PodWorkload(pod)
+
+	var podLabels map[string]string
+	for _, key := range r.PodLabels {
+		if value, ok := pod.Labels[key]; ok {
+			if podLabels == nil {
+				podLabels = make(map[string]string)
+			}
+			podLabels[key] = value
+		}
+	}
+
+	var capture json.RawMessage
+	if value, ok := pod.Annotations[CaptureAnnotation]; ok {
+		// the options are validated by iftop-exporter, only make sure the file stays valid JSON here
+		options := map[string]any{}
+		if err := json.Unmarshal([]byte(value), &options); err != nil {
+			log.Error(err, fmt.Sprintf("pod (%s) annotation (%s) is not a JSON object, ignored", podKey, CaptureAnnotation))
+		} else {
+			capture = json.RawMessage(value)
+		}
+	}
+
 	for interfaceContainer, interfaceNode := range interfacesMapping {
 		interfaceInfo := InterfaceInfo{
+			Version:                InterfaceInfoVersion,
 			Owner:                  fmt.Sprintf("%s/%s", pod.Namespace, pod.Name),
 			ContainerInterfaceName: interfaceContainer,
 			NodeInterfaceName:      interfaceNode,
+			Namespace:              pod.Namespace,
+			Pod:                    pod.Name,
+			WorkloadKind:           workloadKind,
+			Workload:               workload,
+			Labels:                 podLabels,
+			Capture:                capture,
 		}
 
 		v, err := json.MarshalIndent(interfaceInfo, "", "  ")
@@ -181,7 +227,7 @@ func (r *PodReconciler) setInterfaces(ctx context.Context, podKey string, pod *c
 		v = append(v, '\n')
 
 		fileName := filepath.Join(r.DynamicDir, interfaceNode)
-		if err := os.WriteFile(fileName, v, os.ModePerm); err != nil {
+		if err := utils.WriteFileAtomic(fileName, v, os.ModePerm); err != nil {
 			return fmt.Errorf("pod (%s) write interface info file (%s) failed: %s", podKey, fileName, err)
 		}
 		log.Info(fmt.Sprintf("write file (%s) succeeded", fileName))
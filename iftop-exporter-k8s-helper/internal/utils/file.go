@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a hidden temp file in the same directory and renames it to name,
+// so the readers never see a partially written file. The exporter ignores the hidden files.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmpName := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+
+	if err := os.WriteFile(tmpName, data, perm); err != nil {
+		return fmt.Errorf("write temp file (%s) failed, err: %s", tmpName, err)
+	}
+
+	if err := os.Rename(tmpName, name); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("rename temp file (%s) failed, err: %s", tmpName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "veth1234")
+
+	assert.NoError(t, WriteFileAtomic(name, []byte("v1"), 0o644))
+	assert.NoError(t, WriteFileAtomic(name, []byte("v2"), 0o644))
+
+	b, err := os.ReadFile(name)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(b))
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "the temp file is renamed")
+
+	assert.Error(t, WriteFileAtomic(filepath.Join(dir, "no-such-dir", "veth1234"), []byte("v1"), 0o644))
+}
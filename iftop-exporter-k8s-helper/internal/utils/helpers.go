@@ -1,6 +1,10 @@
 package utils
 
-import corev1 "k8s.io/api/core/v1"
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
 
 func IsPodRunning(pod *corev1.Pod) bool {
 	return pod.Status.Phase == "Running"
@@ -16,3 +20,25 @@ func PodNodeName(pod *corev1.Pod) string {
 func PodStatus(pod *corev1.Pod) corev1.PodPhase {
 	return pod.Status.Phase
 }
+
+// PodWorkload returns the kind and name of the workload which controls the pod.
+// The ReplicaSet created by a Deployment is resolved to the Deployment by its pod-template-hash suffix,
+// the Job created by a CronJob is left as is.
+// Both are empty if the pod is not controlled by any workload (a static or bare pod).
+func PodWorkload(pod *corev1.Pod) (kind string, name string) {
+	for _, ownerRef := range pod.OwnerReferences {
+		if ownerRef.Controller == nil || !*ownerRef.Controller {
+			continue
+		}
+
+		kind, name = ownerRef.Kind, ownerRef.Name
+		if kind == "ReplicaSet" {
+			if hash := pod.Labels["pod-template-hash"]; hash != "" && strings.HasSuffix(name, "-"+hash) {
+				kind, name = "Deployment", strings.TrimSuffix(name, "-"+hash)
+			}
+		}
+		return kind, name
+	}
+
+	return "", ""
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodWorkload(t *testing.T) {
+	controller := true
+	newPod := func(kind string, name string, labels map[string]string) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: labels}}
+		if kind != "" {
+			pod.OwnerReferences = []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+		}
+		return pod
+	}
+
+	var tests = []struct {
+		pod          *corev1.Pod
+		expectedKind string
+		expectedName string
+	}{
+		{newPod("ReplicaSet", "nginx-5d8f7b9c4", map[string]string{"pod-template-hash": "5d8f7b9c4"}), "Deployment", "nginx"},
+		{newPod("ReplicaSet", "nginx", nil), "ReplicaSet", "nginx"},
+		{newPod("StatefulSet", "mysql", nil), "StatefulSet", "mysql"},
+		{newPod("", "", nil), "", ""},
+	}
+
+	for _, tt := range tests {
+		kind, name := PodWorkload(tt.pod)
+		assert.Equal(t, tt.expectedKind, kind)
+		assert.Equal(t, tt.expectedName, name)
+	}
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// PeerIndexVersion is the version of the peer index file understood by iftop-exporter.
+const PeerIndexVersion = 1
+
+// The kinds of the peers, see Peer.Kind.
+const (
+	PeerKindPod     = "pod"
+	PeerKindService = "service"
+)
+
+// Peer is the Kubernetes object behind an IP.
+type Peer struct {
+	// Kind is "service" for the cluster IPs of the services and the pods backing a service, "pod" for the other pods.
+	Kind string `json:"kind"`
+	// Owner is namespace/service for the services, namespace/workload for the pods (namespace/pod for the bare pods),
+	// so it stays the same across the rollouts of the workload.
+	Owner        string `json:"owner"`
+	Namespace    string `json:"namespace"`
+	Pod          string `json:"pod,omitempty"`
+	WorkloadKind string `json:"workload_kind,omitempty"`
+	Workload     string `json:"workload,omitempty"`
+	Service      string `json:"service,omitempty"`
+}
+
+// PeerIndex maps the IPs of the pods and the services to their peers, it is written into the peer index file.
+type PeerIndex struct {
+	Version int             `json:"version"`
+	Peers   map[string]Peer `json:"peers"`
+}
+
+// BuildPeerIndex indexes the IPs of the pods and the cluster IPs of the services.
+//
+// A pod which is a ready endpoint of a service is indexed as the service (the first one by name if many),
+// so the traffic to the pods behind a service is attributed to the service wherever it is captured.
+// The host network pods share the node IP, and the finished pods may have released their IPs, both are skipped.
+func BuildPeerIndex(pods []corev1.Pod, services []corev1.Service, endpointSlices []discoveryv1.EndpointSlice) PeerIndex {
+	index := PeerIndex{Version: PeerIndexVersion, Peers: map[string]Peer{}}
+
+	// podServices are the services of each pod, key is namespace/pod
+	podServices := map[string][]string{}
+	for _, slice := range endpointSlices {
+		service := slice.Labels[discoveryv1.LabelServiceName]
+		if service == "" {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" {
+				continue
+			}
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			podKey := fmt.Sprintf("%s/%s", slice.Namespace, endpoint.TargetRef.Name)
+			podServices[podKey] = append(podServices[podKey], service)
+		}
+	}
+
+	// the newer pod wins if an IP is reused
+	sort.SliceStable(pods, func(i, j int) bool {
+		return pods[i].CreationTimestamp.Before(&pods[j].CreationTimestamp)
+	})
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Spec.HostNetwork || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+
+		podKey := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+		workloadKind, workload := PodWorkload(pod)
+		owner := podKey
+		if workload != "" {
+			owner = fmt.Sprintf("%s/%s", pod.Namespace, workload)
+		}
+		peer := Peer{
+			Kind:         PeerKindPod,
+			Owner:        owner,
+			Namespace:    pod.Namespace,
+			Pod:          pod.Name,
+			WorkloadKind: workloadKind,
+			Workload:     workload,
+		}
+		if services := podServices[podKey]; len(services) > 0 {
+			sort.Strings(services)
+			peer.Kind = PeerKindService
+			peer.Owner = fmt.Sprintf("%s/%s", pod.Namespace, services[0])
+			peer.Service = services[0]
+		}
+
+		for _, podIP := range pod.Status.PodIPs {
+			addPeer(index.Peers, podIP.IP, peer)
+		}
+	}
+
+	// the cluster IPs are never pod IPs, they are indexed last to be safe
+	for _, service := range services {
+		peer := Peer{
+			Kind:      PeerKindService,
+			Owner:     fmt.Sprintf("%s/%s", service.Namespace, service.Name),
+			Namespace: service.Namespace,
+			Service:   service.Name,
+		}
+		for _, clusterIP := range service.Spec.ClusterIPs {
+			addPeer(index.Peers, clusterIP, peer)
+		}
+	}
+
+	return index
+}
+
+// addPeer indexes the peer by the canonical form of the IP, the invalid IPs (e.g. "None" of the headless services) are skipped.
+func addPeer(peers map[string]Peer, ip string, peer Peer) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return
+	}
+	peers[addr.Unmap().String()] = peer
+}
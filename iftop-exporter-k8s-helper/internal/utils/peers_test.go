@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildPeerIndex(t *testing.T) {
+	controller := true
+	now := time.Now()
+	newPod := func(name string, ip string, created time.Time) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "default",
+				Name:              name,
+				CreationTimestamp: metav1.NewTime(created),
+				OwnerReferences:   []metav1.OwnerReference{{Kind: "StatefulSet", Name: "db", Controller: &controller}},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIPs: []corev1.PodIP{{IP: ip}}},
+		}
+	}
+
+	newWorker := func(name string, ip string, created time.Time) corev1.Pod {
+		pod := newPod(name, ip, created)
+		pod.Labels = map[string]string{"pod-template-hash": "7d9f"}
+		pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "worker-7d9f", Controller: &controller}}
+		return pod
+	}
+
+	bare := newPod("debug", "10.244.0.8", now)
+	bare.OwnerReferences = nil
+	pods := []corev1.Pod{
+		newPod("db-0", "10.244.0.5", now),
+		newWorker("worker-7d9f-abcde", "10.244.0.6", now),
+		// the newer pod reuses the IP of the old one
+		newPod("db-1", "10.244.0.7", now),
+		newWorker("worker-7d9f-old", "10.244.0.7", now.Add(-time.Hour)),
+		bare,
+	}
+	hostPod := newPod("node-agent", "192.168.0.10", now)
+	hostPod.Spec.HostNetwork = true
+	pods = append(pods, hostPod)
+
+	services := []corev1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec:       corev1.ServiceSpec{ClusterIPs: []string{"10.96.0.20", "fd00::20"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db-headless"},
+			Spec:       corev1.ServiceSpec{ClusterIPs: []string{"None"}},
+		},
+	}
+
+	notReady := false
+	endpointSlices := []discoveryv1.EndpointSlice{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db-abcde", Labels: map[string]string{discoveryv1.LabelServiceName: "db"}},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.244.0.5"}, TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "db-0"}},
+				{Addresses: []string{"10.244.0.6"}, TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "worker-7d9f-abcde"},
+					Conditions: discoveryv1.EndpointConditions{Ready: &notReady}},
+			},
+		},
+	}
+
+	index := BuildPeerIndex(pods, services, endpointSlices)
+	assert.Equal(t, PeerIndexVersion, index.Version)
+	assert.Len(t, index.Peers, 6)
+
+	assert.Equal(t, Peer{Kind: PeerKindService, Owner: "default/db", Namespace: "default", Pod: "db-0",
+		WorkloadKind: "StatefulSet", Workload: "db", Service: "db"}, index.Peers["10.244.0.5"])
+	// the pods are owned by their workloads, the bare pods by themselves
+	assert.Equal(t, Peer{Kind: PeerKindPod, Owner: "default/worker", Namespace: "default", Pod: "worker-7d9f-abcde",
+		WorkloadKind: "Deployment", Workload: "worker"}, index.Peers["10.244.0.6"])
+	assert.Equal(t, "db-1", index.Peers["10.244.0.7"].Pod)
+	assert.Equal(t, "default/db", index.Peers["10.244.0.7"].Owner)
+	assert.Equal(t, Peer{Kind: PeerKindPod, Owner: "default/debug", Namespace: "default", Pod: "debug"}, index.Peers["10.244.0.8"])
+	assert.Equal(t, Peer{Kind: PeerKindService, Owner: "default/db", Namespace: "default", Service: "db"}, index.Peers["fd00::20"])
+	assert.Contains(t, index.Peers, "10.96.0.20")
+	assert.NotContains(t, index.Peers, "192.168.0.10")
+}
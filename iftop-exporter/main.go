@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"log"
 
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
 	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/manager"
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/recorder"
 	pkgVersion "github.com/bougou/iftop-exporter/iftop-exporter/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -21,10 +27,70 @@ func main() {
 	interfaces := fs.String("interfaces", "", "interface names separated by comma")
 	dynamic := fs.Bool("dynamic", false, "dynamic mode")
 	dynamicDir := fs.String("dynamic-dir", "/var/lib/iftop-exporter/dynamic", "dynamic directory")
+	dynamicResyncInterval := fs.Duration("dynamic-resync-interval", manager.DefaultResyncInterval,
+		"how often the dynamic dir is scanned to start the tasks of the present files and stop the tasks of the vanished ones, 0 means only at start")
+	discover := fs.Bool("discover", false, "start and stop iftop tasks for the links selected by -discover-include, -discover-exclude and -discover-types as they come and go")
+	discoverInclude := fs.String("discover-include", "", "regex which must match the whole link name to be discovered, e.g. \"eth.*|bond.*\", empty means all links")
+	discoverExclude := fs.String("discover-exclude", manager.DefaultDiscoverExclude, "regex which must match the whole link name to be ignored by the discovery, it wins over -discover-include")
+	discoverTypes := fs.String("discover-types", "", "link types to be discovered separated by comma, e.g. \"device,bond,vlan\", empty means all types")
+	backend := fs.String("backend", manager.BackendIftop,
+		fmt.Sprintf("capture backend, valid values are: %s, %s", manager.BackendIftop, manager.BackendAFPacket))
 	continuous := fs.Bool("continuous", false, "continuous mode")
 	interval := fs.Duration("interval", 10*time.Second, "interval between two iftop runs, and must not be less than 10 seconds")
 	duration := fs.Duration("duration", 3*time.Second,
 		"duration of each iftop run, and must not be less than 3 seconds, and duration must be less than interval")
+	replayDir := fs.String("replay-dir", "",
+		"replay mode, replay the recorded iftop outputs ({interface}.stdout and {interface}.stderr) under the directory instead of capturing")
+	replaySpeed := fs.Float64("replay-speed", 1, "speed of the replay mode, 1 keeps the original pacing, 0 replays without waiting")
+	recordDir := fs.String("record-dir", "", "record the raw iftop outputs of each run under the directory, disabled if empty")
+	recordMaxBytes := fs.Int64("record-max-bytes", 100*1024*1024, "max total bytes of the records, the oldest records are removed when exceeded")
+	recordMaxAge := fs.Duration("record-max-age", 24*time.Hour, "max age of the records, the older records are removed")
+	flowCounters := fs.Bool("flow-counters", false,
+		"export the per flow iftop_flow_bytes_total counters, which may have a high cardinality (the per zone pair counters are always exported)")
+	staleAfter := fs.Duration("stale-after", 0,
+		"drop the metrics of an interface whose latest round is older than this, 0 means 3 times of interval+duration (at least 30s), negative means never")
+	infoLabels := fs.String("info-labels", manager.DefaultInfoLabels,
+		"comma separated keys of the dynamic interface info exported as labels of all metrics, each item is key or key=label, "+
+			"the nested keys are joined with '.', e.g. namespace,pod,workload,labels.app=app")
+	flowTopK := fs.Int("flow-top-k", 0,
+		"max number of the src/dst pairs exported for each interface, the rest are summed up into src=\"other\",dst=\"other\" flows, 0 means unlimited")
+	flowTopBy := fs.String("flow-top-by", manager.TopBy2s,
+		fmt.Sprintf("the window to rank the flows by for -flow-top-k and -flow-max-series, valid values are: %s, %s, %s, %s",
+			manager.TopBy2s, manager.TopBy10s, manager.TopBy40s, manager.TopByCumulative))
+	flowMaxSeries := fs.Int("flow-max-series", 0,
+		"max number of the flow series of all interfaces, the lower ranked flows are summed up into src=\"other\",dst=\"other\" flows, 0 means unlimited")
+	filter := fs.String("filter", "", "pcap filter code of iftop (-f), e.g. \"not port 8080\" or \"tcp\", only for the iftop backend")
+	netFilter := fs.String("net-filter", "",
+		"IPv4 network (net/mask) which iftop takes as local to determine the direction of the flows (-F), e.g. 10.0.0.0/8, only for the iftop backend")
+	netFilter6 := fs.String("net-filter6", "",
+		"IPv6 network (net/mask) which iftop takes as local to determine the direction of the flows (-G), e.g. fd00::/8, only for the iftop backend")
+	promiscuous := fs.Bool("promiscuous", false, "run iftop in promiscuous mode (-p) to see the traffic not for this host, only for the iftop backend")
+	zones := fs.String("zones", "",
+		"semicolon separated zones of the flow ends exported as src_zone and dst_zone labels, each zone is name=cidr[,cidr...], "+
+			"the most specific cidr wins, e.g. \"pod-cidr=10.244.0.0/16;service-cidr=10.96.0.0/12;datacenter=10.0.0.0/8\", "+
+			"empty means the builtin zones: loopback, link_local, private and cgnat")
+	defaultZone := fs.String("default-zone", iftop.DefaultZone, "the zone of the addresses which match no cidr of -zones, e.g. internet")
+	podDirection := fs.Bool("pod-direction", true,
+		"for the node side veths of the pod interfaces reported by the helper, flip the directions so direction=\"out\" means the egress from the pod")
+	ports := fs.Bool("ports", false,
+		"port mode, run iftop with -P -N and export the ports of the flow ends as src_port and dst_port labels")
+	ephemeralPortMin := fs.Int("ephemeral-port-min", manager.DefaultEphemeralPortMin,
+		"in port mode, the ports from this are collapsed into the \"ephemeral\" port label, 0 means never")
+	portServices := fs.String("port-services", "",
+		"in port mode, comma separated names of the port labels, each item is port=name, e.g. 5432=postgres,6379=redis")
+	peers := fs.Bool("peers", false,
+		"resolve the dst of the flows to the pods and the services by the peer index file which the helper writes into the dynamic dir (--peers of the helper), "+
+			"exported as peer_owner and peer_kind labels, only for the dynamic mode")
+	readyMinFreshRatio := fs.Float64("ready-min-fresh-ratio", manager.DefaultReadyMinFreshRatio,
+		"/readyz fails if the ratio of the tasks which completed a round within the staleness bound (see -stale-after) is below this")
+	backoffMax := fs.Duration("backoff-max", manager.DefaultBackoffMax,
+		"the max delay before restarting a failed iftop task, the delay doubles on each consecutive failure")
+	parkAfter := fs.Int("park-after", manager.DefaultParkAfter,
+		"park an iftop task after this many consecutive failures until its dynamic file changes or its link reappears, 0 means never")
+	maxConcurrentCaptures := fs.Int("max-concurrent-captures", 0,
+		"max number of the concurrent iftop runs, the runs over the limit wait for a slot in turn, 0 means unlimited, only for the periodic mode")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 10*time.Second,
+		"on SIGTERM/SIGINT, how long to wait for the iftop processes to exit after SIGTERM before SIGKILL, and for the http server to drain")
 	version := fs.Bool("version", false, "print version")
 	debug := fs.Bool("debug", false, "debug mode")
 	help := fs.Bool("help", false, "print help")
@@ -46,13 +112,27 @@ func main() {
 
 	fmt.Println("args:", os.Args[1:])
 
-	if !*dynamic && *interfaces == "" {
-		log.Printf("the -dynamic and/or -interfaces option must be specified")
+	if !*dynamic && !*discover && *interfaces == "" && *replayDir == "" {
+		log.Printf("the -dynamic, -discover and/or -interfaces (or -replay-dir) option must be specified")
 		os.Exit(1)
 	}
 
 	interfaceNames := []string{}
-	if *interfaces != "" {
+	if *replayDir != "" {
+		// the recorded interfaces are replayed as static interfaces
+		names, err := iftop.ReplayInterfaces(*replayDir)
+		if err != nil {
+			log.Printf("Err: %s", err)
+			os.Exit(1)
+		}
+		if len(names) == 0 {
+			log.Printf("Err: no recorded interface found in replay dir (%s)", *replayDir)
+			os.Exit(1)
+		}
+		interfaceNames = names
+		*dynamic = false
+		*discover = false
+	} else if *interfaces != "" {
 		for _, name := range strings.Split(*interfaces, ",") {
 			n := strings.TrimSpace(name)
 			if n != "" {
@@ -69,10 +149,110 @@ func main() {
 	}
 
 	iftopManager.WithDebug(*debug)
+	iftopManager.WithFlowCounters(*flowCounters)
+	iftopManager.WithStaleAfter(*staleAfter)
+	iftopManager.WithReadyMinFreshRatio(*readyMinFreshRatio)
+	iftopManager.WithBackoff(*backoffMax, *parkAfter)
+	iftopManager.WithMaxConcurrentCaptures(*maxConcurrentCaptures)
+	iftopManager.WithResyncInterval(*dynamicResyncInterval)
+	iftopManager.WithPodDirection(*podDirection)
+
+	if *discover {
+		linkFilter, err := manager.NewLinkFilter(*discoverInclude, *discoverExclude, *discoverTypes)
+		if err != nil {
+			log.Printf("Err: %s", err)
+			os.Exit(1)
+		}
+		iftopManager.WithDiscovery(linkFilter)
+	}
+
+	infoLabelList, err := manager.ParseInfoLabels(*infoLabels)
+	if err != nil {
+		log.Printf("Err: %s", err)
+		os.Exit(1)
+	}
+	iftopManager.WithInfoLabels(infoLabelList)
+
+	if *zones == "" {
+		*zones = iftop.BuiltinZones
+	}
+	zoneList, err := iftop.ParseZones(*zones, *defaultZone)
+	if err != nil {
+		log.Printf("Err: %s", err)
+		os.Exit(1)
+	}
+	iftopManager.WithZones(zoneList)
+
+	if err := iftopManager.WithPeers(*peers); err != nil {
+		log.Printf("Err: %s", err)
+		os.Exit(1)
+	}
+
+	if *ports {
+		services, err := manager.ParsePortServices(*portServices)
+		if err != nil {
+			log.Printf("Err: %s", err)
+			os.Exit(1)
+		}
+		if err := iftopManager.WithPorts(manager.PortLabels{EphemeralMin: *ephemeralPortMin, Services: services}); err != nil {
+			log.Printf("Err: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	flowLimits := manager.FlowLimits{TopK: *flowTopK, TopBy: *flowTopBy, MaxSeries: *flowMaxSeries}
+	if err := iftopManager.WithFlowLimits(flowLimits); err != nil {
+		log.Printf("Err: %s", err)
+		os.Exit(1)
+	}
+
+	if err := iftopManager.WithBackend(*backend); err != nil {
+		log.Printf("Err: %s", err)
+		os.Exit(1)
+	}
+	log.Printf("capture backend: %s", *backend)
+
+	captureOptions := &manager.CaptureOptions{
+		Filter:     *filter,
+		NetFilter:  *netFilter,
+		NetFilter6: *netFilter6,
+	}
+	if *promiscuous {
+		captureOptions.Promiscuous = promiscuous
+	}
+	if *backend != manager.BackendIftop && (*filter != "" || *netFilter != "" || *netFilter6 != "" || *promiscuous) {
+		log.Printf("Err: -filter, -net-filter, -net-filter6 and -promiscuous are only for the iftop backend")
+		os.Exit(1)
+	}
+	if err := iftopManager.WithCaptureOptions(captureOptions); err != nil {
+		log.Printf("Err: %s", err)
+		os.Exit(1)
+	}
+
+	if *replayDir != "" {
+		iftopManager.WithReplay(*replayDir, *replaySpeed)
+		log.Printf("replay mode enabled, replay dir (%s), speed (%v)", *replayDir, *replaySpeed)
+	}
+
 	log.Printf("iftop execution pattern: continuous=%t, interval=%s, duration=%s", *continuous, *interval, *duration)
 
+	if *backoffMax < 0 {
+		log.Printf("Err: backoff max (%s) must not be negative", *backoffMax)
+		os.Exit(1)
+	}
+
+	if *maxConcurrentCaptures < 0 {
+		log.Printf("Err: max concurrent captures (%d) must not be negative", *maxConcurrentCaptures)
+		os.Exit(1)
+	}
+
 	if *continuous {
 		log.Printf("WARN: continuous mode enabled, this mode may cause high CPU usage")
+
+		if *maxConcurrentCaptures > 0 {
+			log.Printf("Err: max concurrent captures (%d) is only supported in periodic mode, the continuous runs never release their slots", *maxConcurrentCaptures)
+			os.Exit(1)
+		}
 	} else {
 		if *interval < 10*time.Second {
 			log.Printf("Err: interval (%s) must not be less than 10 seconds", *interval)
@@ -90,11 +270,57 @@ func main() {
 		}
 	}
 
+	if *recordDir != "" {
+		outputRecorder, err := recorder.NewRecorder(*recordDir, *recordMaxBytes, *recordMaxAge)
+		if err != nil {
+			log.Printf("Err: %s", err)
+			os.Exit(1)
+		}
+		iftopManager.WithRecorder(outputRecorder)
+		http.Handle("/debug/records", outputRecorder.Handler())
+		log.Printf("record enabled, record dir (%s), max bytes (%d), max age (%s)", *recordDir, *recordMaxBytes, *recordMaxAge)
+	}
+
 	iftopManager.WithContinuous(*continuous, *interval, *duration)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
 	go iftopManager.Run()
 
+	prometheus.MustRegister(iftopManager.Collector())
+
 	http.Handle("/metrics", promhttp.Handler())
-	if err := http.ListenAndServe(*addr, nil); err != nil {
-		fmt.Println(err)
+	http.Handle("/healthz", iftopManager.HealthzHandler())
+	http.Handle("/readyz", iftopManager.ReadyzHandler())
+
+	server := &http.Server{Addr: *addr}
+	serverErrCh := make(chan error, 1)
+	go func() {
+		serverErrCh <- server.ListenAndServe()
+	}()
+
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		log.Printf("got signal, shutting down")
+	case err := <-serverErrCh:
+		log.Printf("http server failed, err: %s", err)
+		exitCode = 1
+	}
+	stop()
+
+	// stop the iftop processes first, they must not be orphaned even if draining the http server takes long
+	if err := iftopManager.Shutdown(*shutdownTimeout); err != nil {
+		log.Printf("shutdown manager failed, err: %s", err)
+		exitCode = 1
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown http server failed, err: %s", err)
+		exitCode = 1
 	}
+	cancel()
+
+	log.Printf("exit")
+	os.Exit(exitCode)
 }
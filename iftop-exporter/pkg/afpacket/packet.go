@@ -0,0 +1,58 @@
+package afpacket
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	ethPIPv4 = 0x0800
+	ethPIPv6 = 0x86DD
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+// parsePacket extracts the addresses, the ports and the IP length of a network-layer packet.
+//
+// The protocol is the ethertype reported by the AF_PACKET socket. Like iftop,
+// the length is taken from the IP header, so it does not include link-layer headers,
+// and it is still correct when the captured data is truncated.
+// The ports are only parsed for TCP and UDP (not behind the IPv6 extension headers), otherwise they are zero.
+func parsePacket(protocol uint16, data []byte) (src netip.AddrPort, dst netip.AddrPort, length int, ok bool) {
+	switch protocol {
+	case ethPIPv4:
+		if len(data) < 20 || data[0]>>4 != 4 {
+			return src, dst, 0, false
+		}
+		srcPort, dstPort := uint16(0), uint16(0)
+		// the non-first fragments carry no transport header
+		if headerLength := int(data[0]&0x0f) * 4; binary.BigEndian.Uint16(data[6:8])&0x1fff == 0 {
+			srcPort, dstPort = parsePorts(data[9], data[min(headerLength, len(data)):])
+		}
+		src = netip.AddrPortFrom(netip.AddrFrom4([4]byte(data[12:16])), srcPort)
+		dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(data[16:20])), dstPort)
+		length = int(binary.BigEndian.Uint16(data[2:4]))
+		return src, dst, length, true
+
+	case ethPIPv6:
+		if len(data) < 40 || data[0]>>4 != 6 {
+			return src, dst, 0, false
+		}
+		srcPort, dstPort := parsePorts(data[6], data[40:])
+		src = netip.AddrPortFrom(netip.AddrFrom16([16]byte(data[8:24])), srcPort)
+		dst = netip.AddrPortFrom(netip.AddrFrom16([16]byte(data[24:40])), dstPort)
+		length = 40 + int(binary.BigEndian.Uint16(data[4:6]))
+		return src, dst, length, true
+	}
+
+	return src, dst, 0, false
+}
+
+// parsePorts extracts the ports of the TCP or UDP header.
+func parsePorts(ipProto byte, transport []byte) (srcPort uint16, dstPort uint16) {
+	if (ipProto != ipProtoTCP && ipProto != ipProtoUDP) || len(transport) < 4 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint16(transport[0:2]), binary.BigEndian.Uint16(transport[2:4])
+}
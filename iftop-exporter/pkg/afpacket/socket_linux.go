@@ -0,0 +1,88 @@
+//go:build linux
+
+package afpacket
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// snapLength is enough for the IPv4/IPv6 headers, the rest of the packet is not needed.
+const snapLength = 128
+
+// errReadTimeout is returned by read when no packet arrives within readTimeout.
+var errReadTimeout = errors.New("read timeout")
+
+type socket struct {
+	fd  int
+	buf []byte
+}
+
+// openSocket opens an AF_PACKET socket bound to the interface.
+//
+// SOCK_DGRAM is used so the kernel strips the link-layer header, which makes
+// ethernet, tun and loopback interfaces all look the same.
+func openSocket(interfaceName string, readTimeout time.Duration) (*socket, error) {
+	intf, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("get interface (%s) failed, err: %w", interfaceName, err)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("create socket failed, err: %w", err)
+	}
+
+	sa := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  intf.Index,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("bind socket to interface (%s) failed, err: %w", interfaceName, err)
+	}
+
+	tv := syscall.NsecToTimeval(readTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("set socket read timeout failed, err: %w", err)
+	}
+
+	return &socket{
+		fd:  fd,
+		buf: make([]byte, snapLength),
+	}, nil
+}
+
+// read returns the next packet (network-layer), its ethertype and whether it is sent by this host.
+func (s *socket) read() (data []byte, protocol uint16, outgoing bool, err error) {
+	n, from, err := syscall.Recvfrom(s.fd, s.buf, 0)
+	if err != nil {
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			return nil, 0, false, errReadTimeout
+		}
+		return nil, 0, false, err
+	}
+
+	sll, ok := from.(*syscall.SockaddrLinklayer)
+	if !ok {
+		return nil, 0, false, errReadTimeout
+	}
+
+	return s.buf[:n], ntohs(sll.Protocol), sll.Pkttype == syscall.PACKET_OUTGOING, nil
+}
+
+func (s *socket) Close() error {
+	return syscall.Close(s.fd)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func ntohs(v uint16) uint16 {
+	return htons(v)
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package afpacket
+
+import (
+	"errors"
+	"time"
+)
+
+var errReadTimeout = errors.New("read timeout")
+
+type socket struct{}
+
+func openSocket(interfaceName string, readTimeout time.Duration) (*socket, error) {
+	return nil, errors.New("AF_PACKET capture is only supported on linux")
+}
+
+func (s *socket) read() (data []byte, protocol uint16, outgoing bool, err error) {
+	return nil, 0, false, errReadTimeout
+}
+
+func (s *socket) Close() error {
+	return nil
+}
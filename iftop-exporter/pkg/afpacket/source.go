@@ -0,0 +1,410 @@
+// Package afpacket implements a pure-Go capture backend which reads packets from
+// an AF_PACKET socket and computes the same 2s/10s/40s windows as iftop.
+package afpacket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+)
+
+const (
+	// readTimeout bounds how long a blocking read may delay Stop.
+	readTimeout = 200 * time.Millisecond
+
+	// publishSeconds is how often the flow stats are published, the same as iftop text mode.
+	publishSeconds = 2
+
+	// defaultNumberOfLines is the number of flows iftop prints when -L is not specified.
+	defaultNumberOfLines = 10
+)
+
+// flowKey identifies a flow by its local and remote address, like an iftop line pair.
+// The ports are zero unless options.ShowPort is set.
+type flowKey struct {
+	local  netip.AddrPort
+	remote netip.AddrPort
+}
+
+type flowCounter struct {
+	sent      rateWindow
+	recv      rateWindow
+	sentBytes float64
+	recvBytes float64
+}
+
+// Source captures packets on an interface and produces iftop.State.
+type Source struct {
+	options iftop.Options
+
+	lock     sync.Mutex
+	flows    map[flowKey]*flowCounter
+	sent     rateWindow
+	recv     rateWindow
+	filled   int // number of completed seconds since the capture started
+	peakSent float64
+	peakRecv float64
+	peakX    float64
+	sentAll  float64
+	recvAll  float64
+	state    iftop.State
+
+	runStart     time.Time
+	round        uint64
+	lastRoundEnd time.Time
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func NewSource(options iftop.Options) *Source {
+	return &Source{
+		options: options,
+		flows:   make(map[flowKey]*flowCounter),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+func (s *Source) ID() string {
+	return s.options.InterfaceName
+}
+
+// State returns the snapshot published by the latest round.
+func (s *Source) State() iftop.State {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// Stop stops the capture, Run returns after the socket is closed.
+func (s *Source) Stop() error {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	return nil
+}
+
+// Run captures until Stop is called, or until options.SingleSeconds elapsed
+// (the equivalent of `iftop -s`), in which case the final round is published before return.
+func (s *Source) Run() error {
+	return s.RunContext(context.Background())
+}
+
+// RunContext is like Run, but stops the capture when ctx is done.
+func (s *Source) RunContext(ctx context.Context) error {
+	stopCapture := context.AfterFunc(ctx, func() {
+		s.Stop()
+	})
+	defer stopCapture()
+
+	if err := s.options.Valid(); err != nil {
+		return err
+	}
+	// the filters are compiled by libpcap, the packets are captured without it here
+	if s.options.Filter != "" || s.options.NetFilter != "" || s.options.NetFilter6 != "" {
+		return fmt.Errorf("%w, the filters are not supported by the afpacket backend", iftop.ErrBadFilter)
+	}
+
+	sock, err := openSocket(s.options.InterfaceName, readTimeout)
+	if err != nil {
+		return fmt.Errorf("open AF_PACKET socket failed, err: %s", err)
+	}
+	defer sock.Close()
+
+	s.initState()
+
+	captureErrCh := make(chan error, 1)
+	go func() {
+		captureErrCh <- s.capture(sock)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	elapsed := 0
+	for {
+		select {
+		case <-ticker.C:
+			s.tick()
+			elapsed++
+
+			if s.options.SingleSeconds > 0 && elapsed >= s.options.SingleSeconds {
+				s.publish()
+				s.Stop()
+				return <-captureErrCh
+			}
+
+			if elapsed%publishSeconds == 0 {
+				s.publish()
+			}
+
+		case err := <-captureErrCh:
+			return err
+		}
+	}
+}
+
+// initState fills the interface information which iftop prints to stderr.
+func (s *Source) initState() {
+	runStart := time.Now()
+	state := iftop.State{
+		Interface: s.options.InterfaceName,
+		RunStart:  runStart,
+	}
+
+	if intf, err := net.InterfaceByName(s.options.InterfaceName); err == nil {
+		state.MAC = intf.HardwareAddr.String()
+
+		addrs, _ := intf.Addrs()
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				if state.IP == "" {
+					state.IP = ipNet.IP.String()
+				}
+			} else if state.IPv6 == "" {
+				state.IPv6 = ipNet.IP.String()
+			}
+		}
+	}
+
+	s.lock.Lock()
+	s.state = state
+	s.runStart = runStart
+	s.lock.Unlock()
+}
+
+// capture reads packets until the source is stopped.
+func (s *Source) capture(sock *socket) error {
+	for {
+		select {
+		case <-s.stopCh:
+			return nil
+		default:
+		}
+
+		data, protocol, outgoing, err := sock.read()
+		if err != nil {
+			if errors.Is(err, errReadTimeout) {
+				continue
+			}
+			return fmt.Errorf("read packet failed, err: %s", err)
+		}
+
+		src, dst, length, ok := parsePacket(protocol, data)
+		if !ok {
+			continue
+		}
+
+		s.account(src, dst, float64(length), outgoing)
+	}
+}
+
+func (s *Source) account(src netip.AddrPort, dst netip.AddrPort, bytes float64, outgoing bool) {
+	if !s.options.ShowPort {
+		src = netip.AddrPortFrom(src.Addr(), 0)
+		dst = netip.AddrPortFrom(dst.Addr(), 0)
+	}
+
+	// The flows are keyed from the perspective of this host, like iftop does,
+	// the left column is the local address.
+	key := flowKey{local: dst, remote: src}
+	if outgoing {
+		key = flowKey{local: src, remote: dst}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	flow, ok := s.flows[key]
+	if !ok {
+		flow = &flowCounter{}
+		s.flows[key] = flow
+	}
+
+	if outgoing {
+		flow.sent.add(bytes)
+		flow.sentBytes += bytes
+		s.sent.add(bytes)
+		s.sentAll += bytes
+	} else {
+		flow.recv.add(bytes)
+		flow.recvBytes += bytes
+		s.recv.add(bytes)
+		s.recvAll += bytes
+	}
+}
+
+// tick completes the current second of all windows.
+func (s *Source) tick() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sent.rotate()
+	s.recv.rotate()
+	if s.filled < windowSeconds {
+		s.filled++
+	}
+
+	for key, flow := range s.flows {
+		flow.sent.rotate()
+		flow.recv.rotate()
+
+		// Like iftop, forget the flows which have no traffic in the whole window.
+		if flow.sent.empty() && flow.recv.empty() {
+			delete(s.flows, key)
+		}
+	}
+
+	sentRate := s.sent.rateBits(publishSeconds, s.filled)
+	recvRate := s.recv.rateBits(publishSeconds, s.filled)
+	s.peakSent = max(s.peakSent, sentRate)
+	s.peakRecv = max(s.peakRecv, recvRate)
+	s.peakX = max(s.peakX, sentRate+recvRate)
+}
+
+// publish builds the FlowStats of this round in the same shape as the iftop text parser.
+func (s *Source) publish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	type pair struct {
+		key flowKey
+		out *iftop.Flow
+		in  *iftop.Flow
+	}
+
+	pairs := make([]pair, 0, len(s.flows))
+	for key, flow := range s.flows {
+		src := key.local.Addr().String()
+		dst := key.remote.Addr().String()
+		srcPort := formatPort(key.local.Port())
+		dstPort := formatPort(key.remote.Port())
+		srcZone := s.options.Zones.Lookup(src)
+		dstZone := s.options.Zones.Lookup(dst)
+
+		pairs = append(pairs, pair{
+			key: key,
+			out: &iftop.Flow{
+				Src:             src,
+				Dst:             dst,
+				Direction:       iftop.FlowDirectionOut,
+				SrcPort:         srcPort,
+				DstPort:         dstPort,
+				SrcZone:         srcZone,
+				DstZone:         dstZone,
+				Last2RateBits:   flow.sent.rateBits(2, s.filled),
+				Last10RateBits:  flow.sent.rateBits(10, s.filled),
+				Last40RateBits:  flow.sent.rateBits(40, s.filled),
+				CumulativeBytes: flow.sentBytes,
+			},
+			in: &iftop.Flow{
+				Src:             src,
+				Dst:             dst,
+				Direction:       iftop.FlowDirectionIn,
+				SrcPort:         srcPort,
+				DstPort:         dstPort,
+				SrcZone:         srcZone,
+				DstZone:         dstZone,
+				Last2RateBits:   flow.recv.rateBits(2, s.filled),
+				Last10RateBits:  flow.recv.rateBits(10, s.filled),
+				Last40RateBits:  flow.recv.rateBits(40, s.filled),
+				CumulativeBytes: flow.recvBytes,
+			},
+		})
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool {
+		a, b := pairs[i], pairs[j]
+		switch s.options.SortBy {
+		case iftop.SortBySource:
+			return a.key.local.Compare(b.key.local) < 0
+		case iftop.SortByDestination:
+			return a.key.remote.Compare(b.key.remote) < 0
+		case iftop.SortBy10s:
+			return a.out.Last10RateBits+a.in.Last10RateBits > b.out.Last10RateBits+b.in.Last10RateBits
+		case iftop.SortBy40s:
+			return a.out.Last40RateBits+a.in.Last40RateBits > b.out.Last40RateBits+b.in.Last40RateBits
+		default:
+			return a.out.Last2RateBits+a.in.Last2RateBits > b.out.Last2RateBits+b.in.Last2RateBits
+		}
+	})
+
+	numberOfLines := s.options.NumberOfLines
+	if numberOfLines <= 0 {
+		numberOfLines = defaultNumberOfLines
+	}
+	if len(pairs) > numberOfLines {
+		pairs = pairs[:numberOfLines]
+	}
+
+	flowStats := &iftop.FlowStats{
+		Flows: make([]*iftop.Flow, 0, len(pairs)*2+4),
+
+		TotalSentLast2RateBits:  s.sent.rateBits(2, s.filled),
+		TotalSentLast10RateBits: s.sent.rateBits(10, s.filled),
+		TotalSentLast40RateBits: s.sent.rateBits(40, s.filled),
+
+		TotalRecvLast2RateBits:  s.recv.rateBits(2, s.filled),
+		TotalRecvLast10RateBits: s.recv.rateBits(10, s.filled),
+		TotalRecvLast40RateBits: s.recv.rateBits(40, s.filled),
+
+		PeakSentRateBits:        s.peakSent,
+		PeakRecvRateBits:        s.peakRecv,
+		PeakSentAndRecvRateBits: s.peakX,
+
+		CumulativeSentBytes:        s.sentAll,
+		CumulativeRecvBytes:        s.recvAll,
+		CumulativeSentAndRecvBytes: s.sentAll + s.recvAll,
+	}
+	flowStats.TotalSentAndRecvLast2RateBits = flowStats.TotalSentLast2RateBits + flowStats.TotalRecvLast2RateBits
+	flowStats.TotalSentAndRecvLast10RateBits = flowStats.TotalSentLast10RateBits + flowStats.TotalRecvLast10RateBits
+	flowStats.TotalSentAndRecvLast40RateBits = flowStats.TotalSentLast40RateBits + flowStats.TotalRecvLast40RateBits
+
+	for i, p := range pairs {
+		p.out.Index = i + 1
+		p.in.Index = i + 1
+		flowStats.Flows = append(flowStats.Flows, p.out, p.in)
+	}
+
+	if len(flowStats.Flows) > 0 {
+		flowStats.Flows = append(flowStats.Flows, iftop.SumFlows(flowStats.Flows)...)
+	}
+
+	now := time.Now()
+	s.round++
+	roundStart := s.lastRoundEnd
+	if roundStart.IsZero() {
+		roundStart = s.runStart
+	}
+	s.lastRoundEnd = now
+
+	// the published state is replaced as a whole, so the readers always get a consistent snapshot.
+	state := s.state
+	state.FlowStats = flowStats
+	state.Round = s.round
+	state.RoundStart = roundStart
+	state.RoundEnd = now
+	state.RunStart = s.runStart
+	state.RunDuration = now.Sub(s.runStart)
+	s.state = state
+}
+
+// formatPort formats the port like iftop -P -N, zero means no port.
+func formatPort(port uint16) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(port))
+}
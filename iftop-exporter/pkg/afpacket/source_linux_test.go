@@ -0,0 +1,133 @@
+//go:build linux
+
+package afpacket
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// TestSourceVethPair captures on one end of a veth pair whose peer lives in another network namespace.
+func TestSourceVethPair(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root to create network namespaces")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	require.NoError(t, err)
+	defer origin.Close()
+	defer netns.Set(origin)
+
+	peerNS, err := netns.New()
+	if err != nil {
+		t.Skipf("create network namespace failed, err: %s", err)
+	}
+	defer peerNS.Close()
+
+	localNS, err := netns.New()
+	require.NoError(t, err)
+	defer localNS.Close()
+
+	// now the current thread is in localNS
+	veth := &netlink.Veth{
+		LinkAttrs:     netlink.LinkAttrs{Name: "afp0"},
+		PeerName:      "afp1",
+		PeerNamespace: netlink.NsFd(int(peerNS)),
+	}
+	require.NoError(t, netlink.LinkAdd(veth))
+
+	local, err := netlink.LinkByName("afp0")
+	require.NoError(t, err)
+	localAddr, _ := netlink.ParseAddr("10.123.0.1/24")
+	require.NoError(t, netlink.AddrAdd(local, localAddr))
+	require.NoError(t, netlink.LinkSetUp(local))
+
+	peerHandle, err := netlink.NewHandleAt(peerNS)
+	require.NoError(t, err)
+	defer peerHandle.Close()
+	peer, err := peerHandle.LinkByName("afp1")
+	require.NoError(t, err)
+	peerAddr, _ := netlink.ParseAddr("10.123.0.2/24")
+	require.NoError(t, peerHandle.AddrAdd(peer, peerAddr))
+	require.NoError(t, peerHandle.LinkSetUp(peer))
+
+	// a permanent neighbor entry, so no packet is dropped while resolving ARP
+	require.NoError(t, netlink.NeighAdd(&netlink.Neigh{
+		LinkIndex:    local.Attrs().Index,
+		State:        netlink.NUD_PERMANENT,
+		IP:           net.ParseIP("10.123.0.2"),
+		HardwareAddr: peer.Attrs().HardwareAddr,
+	}))
+
+	source := NewSource(iftop.Options{
+		InterfaceName: "afp0",
+		SingleSeconds: 3,
+	})
+
+	runErrCh := make(chan error, 1)
+	go func() {
+		// the socket must be opened in localNS
+		runtime.LockOSThread()
+		if err := netns.Set(localNS); err != nil {
+			runErrCh <- err
+			return
+		}
+		runErrCh <- source.Run()
+	}()
+
+	require.Eventually(t, func() bool {
+		return source.State().Interface != ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// not connected, so the ICMP port unreachable replies do not fail the following writes
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("10.123.0.1")})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	const packets = 20
+	payload := make([]byte, 1000)
+	peerUDPAddr := &net.UDPAddr{IP: net.ParseIP("10.123.0.2"), Port: 9}
+	for i := 0; i < packets; i++ {
+		_, err := conn.WriteToUDP(payload, peerUDPAddr)
+		require.NoError(t, err)
+	}
+
+	select {
+	case err := <-runErrCh:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("source did not exit after SingleSeconds")
+	}
+
+	state := source.State()
+	require.NotNil(t, state.FlowStats)
+	assert.Equal(t, "10.123.0.1", state.IP)
+
+	var out *iftop.Flow
+	for _, flow := range state.FlowStats.Flows {
+		if flow.Src == "10.123.0.1" && flow.Dst == "10.123.0.2" && flow.Direction == iftop.FlowDirectionOut {
+			out = flow
+		}
+	}
+	require.NotNil(t, out, "flow 10.123.0.1 => 10.123.0.2 not found")
+
+	// IP header (20) + UDP header (8) + payload
+	expectedBytes := float64(packets * (20 + 8 + len(payload)))
+	assert.Equal(t, expectedBytes, out.CumulativeBytes)
+	assert.Equal(t, "private", out.SrcZone)
+	assert.Equal(t, "private", out.DstZone)
+	assert.Greater(t, out.Last40RateBits, 0.0)
+	assert.GreaterOrEqual(t, state.FlowStats.CumulativeSentBytes, expectedBytes)
+}
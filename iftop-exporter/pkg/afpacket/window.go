@@ -0,0 +1,51 @@
+package afpacket
+
+// windowSeconds is the longest window iftop reports (last 40s).
+const windowSeconds = 40
+
+// rateWindow keeps the bytes seen in the last windowSeconds seconds, one bucket per second.
+//
+// The bucket at head is the current (incomplete) second, and the buckets before it
+// are the completed seconds, so the ring holds one more bucket than windowSeconds.
+type rateWindow struct {
+	buckets [windowSeconds + 1]float64
+	head    int
+}
+
+// add accounts bytes into the current second.
+func (w *rateWindow) add(bytes float64) {
+	w.buckets[w.head] += bytes
+}
+
+// rotate completes the current second and starts a new one.
+func (w *rateWindow) rotate() {
+	w.head = (w.head + 1) % len(w.buckets)
+	w.buckets[w.head] = 0
+}
+
+// rateBits returns the rate (bits per second) over the last completed seconds.
+//
+// Like iftop, when the capture has not run long enough to fill the window,
+// the rate is averaged over the elapsed seconds (filled) instead of the full window.
+func (w *rateWindow) rateBits(seconds int, filled int) float64 {
+	n := min(seconds, filled, windowSeconds)
+	if n <= 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for i := 1; i <= n; i++ {
+		sum += w.buckets[(w.head-i+len(w.buckets))%len(w.buckets)]
+	}
+	return sum * 8 / float64(n)
+}
+
+// empty reports whether no bytes are seen in the whole window.
+func (w *rateWindow) empty() bool {
+	for _, bytes := range w.buckets {
+		if bytes != 0 {
+			return false
+		}
+	}
+	return true
+}
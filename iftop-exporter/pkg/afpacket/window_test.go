@@ -0,0 +1,94 @@
+package afpacket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateWindow(t *testing.T) {
+	w := rateWindow{}
+	filled := 0
+
+	// 1000 bytes per second for 5 seconds
+	for i := 0; i < 5; i++ {
+		w.add(1000)
+		w.rotate()
+		filled++
+	}
+
+	assert.Equal(t, 8000.0, w.rateBits(2, filled))
+	// not enough history for 10s and 40s, averaged over the elapsed seconds
+	assert.Equal(t, 8000.0, w.rateBits(10, filled))
+	assert.Equal(t, 8000.0, w.rateBits(40, filled))
+
+	// idle for 5 seconds
+	for i := 0; i < 5; i++ {
+		w.rotate()
+		filled++
+	}
+
+	assert.Equal(t, 0.0, w.rateBits(2, filled))
+	assert.Equal(t, 4000.0, w.rateBits(10, filled))
+	assert.Equal(t, 4000.0, w.rateBits(40, filled))
+	assert.False(t, w.empty())
+
+	// the bytes in the current (incomplete) second are not counted
+	w.add(1000)
+	assert.Equal(t, 0.0, w.rateBits(2, filled))
+
+	// the window forgets everything after 40 idle seconds
+	for i := 0; i < windowSeconds+1; i++ {
+		w.rotate()
+		filled = min(filled+1, windowSeconds)
+	}
+	assert.True(t, w.empty())
+	assert.Equal(t, 0.0, w.rateBits(40, filled))
+}
+
+func TestParsePacket(t *testing.T) {
+	ipv4 := make([]byte, 20)
+	ipv4[0] = 0x45
+	ipv4[2], ipv4[3] = 0x05, 0xdc // total length 1500
+	copy(ipv4[12:16], []byte{10, 0, 0, 1})
+	copy(ipv4[16:20], []byte{10, 0, 0, 2})
+
+	src, dst, length, ok := parsePacket(ethPIPv4, ipv4)
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1:0", src.String())
+	assert.Equal(t, "10.0.0.2:0", dst.String())
+	assert.Equal(t, 1500, length)
+
+	// udp 45678 => 53
+	udp := append([]byte{}, ipv4...)
+	udp[9] = ipProtoUDP
+	udp = append(udp, 0xb2, 0x6e, 0x00, 0x35, 0x00, 0x08, 0x00, 0x00)
+	src, dst, _, ok = parsePacket(ethPIPv4, udp)
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1:45678", src.String())
+	assert.Equal(t, "10.0.0.2:53", dst.String())
+
+	// the non-first fragment has no ports
+	udp[6], udp[7] = 0x00, 0x10
+	src, _, _, ok = parsePacket(ethPIPv4, udp)
+	assert.True(t, ok)
+	assert.Equal(t, uint16(0), src.Port())
+
+	ipv6 := make([]byte, 40)
+	ipv6[0] = 0x60
+	ipv6[4], ipv6[5] = 0x00, 0x10 // payload length 16
+	ipv6[23] = 1
+	ipv6[39] = 2
+
+	src, dst, length, ok = parsePacket(ethPIPv6, ipv6)
+	assert.True(t, ok)
+	assert.Equal(t, "[::1]:0", src.String())
+	assert.Equal(t, "[::2]:0", dst.String())
+	assert.Equal(t, 56, length)
+
+	_, _, _, ok = parsePacket(0x0806, ipv4) // ARP
+	assert.False(t, ok)
+
+	_, _, _, ok = parsePacket(ethPIPv4, ipv4[:10])
+	assert.False(t, ok)
+}
@@ -31,6 +31,16 @@ func (r Command) Run() error {
 	return r.cmd.Wait()
 }
 
+// Start starts iftop process but does not wait for it to complete.
+func (r Command) Start() error {
+	return r.cmd.Start()
+}
+
+// Wait waits for the started iftop process to exit.
+func (r Command) Wait() error {
+	return r.cmd.Wait()
+}
+
 // GetCmd return the underlying exec.Cmd.
 func (r Command) GetCmd() *exec.Cmd {
 	return r.cmd
@@ -48,6 +58,7 @@ func NewIftop(options Options) *Command {
 	arguments = append(arguments, getArguments(options)...)
 
 	cmd := exec.Command(binaryPath, arguments...)
+	setProcessGroup(cmd)
 	return &Command{
 		cmd:     cmd,
 		options: options,
@@ -0,0 +1,106 @@
+package iftop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The kinds of the iftop failures, use errors.Is to check the error returned by Task.Run.
+var (
+	// ErrInterfaceNotFound means the interface does not exist (any more), retrying does not help until it comes back.
+	ErrInterfaceNotFound = errors.New("interface not found")
+	// ErrPermissionDenied means iftop is not allowed to capture, e.g. CAP_NET_RAW is missing.
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrBinaryNotFound means stdbuf or iftop is not installed.
+	ErrBinaryNotFound = errors.New("binary not found")
+	// ErrBadFilter means the filter code is rejected by libpcap.
+	ErrBadFilter = errors.New("bad filter")
+)
+
+// The reasons of the failures, see ErrorReason.
+const (
+	ReasonInterfaceNotFound = "interface_not_found"
+	ReasonPermissionDenied  = "permission_denied"
+	ReasonBinaryNotFound    = "binary_not_found"
+	ReasonBadFilter         = "bad_filter"
+	ReasonHang              = "hang"
+	ReasonCancelled         = "cancelled"
+	ReasonUnknown           = "unknown"
+)
+
+// stderrErrors are the known iftop and libpcap error messages, the first matched one wins.
+var stderrErrors = []struct {
+	kind      error
+	fragments []string
+}{
+	// stdbuf: failed to run command 'iftop': No such file or directory
+	{ErrBinaryNotFound, []string{"failed to run command"}},
+	// pcap_open_live(eth9): eth9: No such device exists (SIOCGIFHWADDR: No such device)
+	{ErrInterfaceNotFound, []string{"No such device", "no suitable device found"}},
+	// pcap_open_live(eth0): eth0: You don't have permission to capture on that device (socket: Operation not permitted)
+	{ErrPermissionDenied, []string{"Permission denied", "Operation not permitted"}},
+	// iftop: port 80 and: syntax error
+	{ErrBadFilter, []string{"syntax error", "parse filter expression", "pcap_compile"}},
+}
+
+// matchStderrError returns the kind of the error if the stderr line is a known error message.
+func matchStderrError(line string) error {
+	for _, stderrError := range stderrErrors {
+		for _, fragment := range stderrError.fragments {
+			if strings.Contains(strings.ToLower(line), strings.ToLower(fragment)) {
+				return stderrError.kind
+			}
+		}
+	}
+	return nil
+}
+
+// RunError is returned by Task.Run if iftop failed and the failure is recognised from its stderr.
+type RunError struct {
+	// Kind is one of the Err* errors.
+	Kind error
+	// Message is the stderr line which the Kind is recognised from.
+	Message string
+	// Err is the error returned by the process, e.g. *exec.ExitError.
+	Err error
+}
+
+func (e *RunError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s, err: %s", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s (%s), err: %s", e.Kind, e.Message, e.Err)
+}
+
+// Unwrap makes both the Kind and the Err visible to errors.Is and errors.As.
+func (e *RunError) Unwrap() []error {
+	errs := []error{e.Kind}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// ErrorReason returns the short reason of the error returned by Run, used as a metric label.
+func ErrorReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrInterfaceNotFound):
+		return ReasonInterfaceNotFound
+	case errors.Is(err, ErrPermissionDenied):
+		return ReasonPermissionDenied
+	case errors.Is(err, ErrBinaryNotFound):
+		return ReasonBinaryNotFound
+	case errors.Is(err, ErrBadFilter):
+		return ReasonBadFilter
+	case errors.Is(err, ErrHang):
+		return ReasonHang
+	case errors.Is(err, context.Canceled):
+		return ReasonCancelled
+	default:
+		return ReasonUnknown
+	}
+}
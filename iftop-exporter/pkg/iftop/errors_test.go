@@ -0,0 +1,76 @@
+//go:build unix
+
+package iftop
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_matchStderrError(t *testing.T) {
+	tests := []struct {
+		line string
+		want error
+	}{
+		{"pcap_open_live(eth0): eth0: socket: Permission denied", ErrPermissionDenied},
+		{"pcap_open_live(eth0): eth0: You don't have permission to capture on that device (socket: Operation not permitted)", ErrPermissionDenied},
+		{"could not open config file with permission 0600, using defaults", nil},
+		{"interface: eth0", nil},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, matchStderrError(tt.line), tt.line)
+	}
+}
+
+func TestTaskRunError(t *testing.T) {
+	tests := []struct {
+		stderr string
+		kind   error
+		reason string
+	}{
+		{"pcap_open_live(eth9): eth9: No such device exists (SIOCGIFHWADDR: No such device)", ErrInterfaceNotFound, ReasonInterfaceNotFound},
+		{"pcap_open_live(eth0): eth0: You don't have permission to capture on that device (socket: Operation not permitted)", ErrPermissionDenied, ReasonPermissionDenied},
+		{"stdbuf: failed to run command 'iftop': No such file or directory", ErrBinaryNotFound, ReasonBinaryNotFound},
+		{"iftop: port 80 and: syntax error", ErrBadFilter, ReasonBadFilter},
+	}
+
+	for _, tt := range tests {
+		task := NewTask(Options{InterfaceName: "eth0"})
+		task.iftop.cmd = exec.Command("sh", "-c", `echo "interface: eth0"; echo "$0" >&2; exit 1`, tt.stderr)
+
+		err := task.Run()
+		assert.ErrorIs(t, err, tt.kind, tt.stderr)
+		assert.Equal(t, tt.reason, ErrorReason(err))
+
+		var runErr *RunError
+		if assert.ErrorAs(t, err, &runErr) {
+			assert.Equal(t, tt.stderr, runErr.Message)
+		}
+		var exitErr *exec.ExitError
+		if assert.ErrorAs(t, err, &exitErr) {
+			assert.Equal(t, 1, exitErr.ExitCode())
+		}
+	}
+
+	// the known messages are ignored if iftop exits without error
+	task := NewTask(Options{InterfaceName: "eth0"})
+	task.iftop.cmd = exec.Command("sh", "-c", `echo "eth0: No such device" >&2`)
+	assert.NoError(t, task.Run())
+
+	// an unknown failure is returned as is
+	task = NewTask(Options{InterfaceName: "eth0"})
+	task.iftop.cmd = exec.Command("sh", "-c", `echo "something went wrong" >&2; exit 2`)
+	err := task.Run()
+	assert.Error(t, err)
+	assert.Equal(t, ReasonUnknown, ErrorReason(err))
+
+	// the binary is missing
+	task = NewTask(Options{InterfaceName: "eth0"})
+	task.iftop.cmd = exec.Command("iftop-exporter-no-such-binary")
+	err = task.Run()
+	assert.ErrorIs(t, err, ErrBinaryNotFound)
+	assert.ErrorIs(t, err, exec.ErrNotFound)
+}
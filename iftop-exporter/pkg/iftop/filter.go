@@ -0,0 +1,124 @@
+package iftop
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"unicode"
+)
+
+// arithmeticOperators are the operators of the arithmetic and relational expressions,
+// e.g. "tcp[tcpflags] & (tcp-syn|tcp-fin) != 0", an operand follows each of them.
+var arithmeticOperators = []string{"<<", ">>", "<=", ">=", "!=", "==", "&", "|", "+", "-", "*", "/", "%", "^", "=", "<", ">"}
+
+// ValidFilter checks the pcap filter code (iftop -f) before iftop is started.
+//
+// It catches the common mistakes (unbalanced parentheses, dangling operators), the filter is fully
+// compiled by libpcap when iftop starts, which fails the run with ErrBadFilter.
+func ValidFilter(filter string) error {
+	if filter == "" {
+		return nil
+	}
+
+	badFilter := func(reason string) error {
+		return fmt.Errorf("%w (%s), %s", ErrBadFilter, filter, reason)
+	}
+
+	for _, r := range filter {
+		if unicode.IsControl(r) && r != '\t' {
+			return badFilter("control characters are not allowed")
+		}
+	}
+
+	tokens := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(filter))
+	if len(tokens) == 0 {
+		return badFilter("empty filter")
+	}
+
+	depth := 0
+	// expectOperand is true at the start, after an operator and after "(".
+	expectOperand := true
+	for _, token := range tokens {
+		switch strings.ToLower(token) {
+		case "(":
+			if !expectOperand {
+				return badFilter("missing operator before (")
+			}
+			depth++
+		case ")":
+			if expectOperand {
+				return badFilter("missing operand before )")
+			}
+			if depth--; depth < 0 {
+				return badFilter("unbalanced parentheses")
+			}
+		case "and", "or", "&&", "||":
+			if expectOperand {
+				return badFilter(fmt.Sprintf("missing operand before (%s)", token))
+			}
+			expectOperand = true
+		case "not", "!":
+			if !expectOperand {
+				return badFilter(fmt.Sprintf("missing operator before (%s)", token))
+			}
+		default:
+			// a primitive may have several words, e.g. "dst port 80",
+			// an arithmetic operator may be attached to its left operand, e.g. "tcp[13]&"
+			expectOperand = endsWithArithmeticOperator(token)
+		}
+	}
+
+	if depth != 0 {
+		return badFilter("unbalanced parentheses")
+	}
+	if expectOperand {
+		return badFilter("missing operand at the end")
+	}
+	return nil
+}
+
+func endsWithArithmeticOperator(token string) bool {
+	for _, operator := range arithmeticOperators {
+		if strings.HasSuffix(token, operator) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidNetFilter checks the network of iftop -F (ipv6 false) or -G (ipv6 true),
+// which is "net/mask", the mask is the prefix length or the dotted mask (IPv4 only), e.g. "10.0.0.0/8", "10.0.0.0/255.0.0.0".
+func ValidNetFilter(netFilter string, ipv6 bool) error {
+	if netFilter == "" {
+		return nil
+	}
+
+	addr, mask, ok := strings.Cut(netFilter, "/")
+	if !ok {
+		return fmt.Errorf("invalid net filter (%s), must be net/mask", netFilter)
+	}
+
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return fmt.Errorf("invalid net filter (%s), err: %s", netFilter, err)
+	}
+	if ip.Is6() != ipv6 {
+		if ipv6 {
+			return fmt.Errorf("invalid net filter (%s), must be an IPv6 network", netFilter)
+		}
+		return fmt.Errorf("invalid net filter (%s), must be an IPv4 network", netFilter)
+	}
+
+	if _, err := netip.ParsePrefix(netFilter); err == nil {
+		return nil
+	}
+	if !ipv6 {
+		if m := net.ParseIP(mask).To4(); m != nil {
+			if _, bits := net.IPMask(m).Size(); bits != 0 {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("invalid net filter (%s), invalid mask (%s)", netFilter, mask)
+}
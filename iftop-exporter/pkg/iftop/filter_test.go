@@ -0,0 +1,72 @@
+package iftop
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidFilter(t *testing.T) {
+	for _, filter := range []string{
+		"",
+		"tcp",
+		"not port 8080",
+		"tcp and not (dst port 10250 or dst port 10256)",
+		"!(host 10.0.0.1)&&udp",
+		"net 10.0.0.0/8 || host fd00::1",
+		"tcp[tcpflags] & (tcp-syn|tcp-fin) != 0",
+		"tcp[13]&(tcp-syn) != 0 and (ip[2:2] > 576)",
+		"len <= (64 + 4)",
+	} {
+		assert.NoError(t, ValidFilter(filter), filter)
+	}
+
+	for _, filter := range []string{
+		"port 80 and",
+		"and port 80",
+		"(port 80",
+		"port 80)",
+		"port 80 or or tcp",
+		"()",
+		"tcp not udp",
+		"not",
+		"port 80\nor tcp",
+		"tcp[13] &",
+		"tcp (port 80)",
+	} {
+		err := ValidFilter(filter)
+		assert.True(t, errors.Is(err, ErrBadFilter), filter)
+	}
+}
+
+func TestValidNetFilter(t *testing.T) {
+	assert.NoError(t, ValidNetFilter("", false))
+	assert.NoError(t, ValidNetFilter("10.0.0.0/8", false))
+	assert.NoError(t, ValidNetFilter("10.0.0.0/255.0.0.0", false))
+	assert.NoError(t, ValidNetFilter("fd00::/8", true))
+
+	assert.Error(t, ValidNetFilter("10.0.0.0", false))
+	assert.Error(t, ValidNetFilter("10.0.0.0/33", false))
+	assert.Error(t, ValidNetFilter("10.0.0.0/255.0.255.0", false))
+	assert.Error(t, ValidNetFilter("fd00::/8", false))
+	assert.Error(t, ValidNetFilter("10.0.0.0/8", true))
+}
+
+func TestGetArgumentsFilters(t *testing.T) {
+	options := Options{
+		InterfaceName: "eth0",
+		Filter:        "not port 8080",
+		NetFilter:     "10.0.0.0/8",
+		NetFilter6:    "fd00::/8",
+		Promiscuous:   true,
+	}
+	assert.NoError(t, options.Valid())
+	assert.Equal(t, []string{"-i", "eth0", "-f", "not port 8080", "-F", "10.0.0.0/8", "-G", "fd00::/8", "-p"}, getArguments(options))
+
+	// a bad filter fails the run before iftop is started
+	options.Filter = "port 80 and"
+	err := NewTask(options).Run()
+	assert.True(t, errors.Is(err, ErrBadFilter))
+	assert.Equal(t, ReasonBadFilter, ErrorReason(err))
+}
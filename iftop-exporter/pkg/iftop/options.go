@@ -11,6 +11,11 @@ type Options struct {
 	ShowBandwidthInBytes bool   // Display bandwidth in bytes
 	NumberOfLines        int    // number of lines to print
 	SingleSeconds        int    // print one single text output afer num seconds, then quit
+	Filter               string // pcap filter code, e.g. "not port 8080", see ValidFilter
+	NetFilter            string // IPv4 network to determine the direction of the flows, e.g. "10.0.0.0/8"
+	NetFilter6           string // IPv6 network to determine the direction of the flows, e.g. "fd00::/8"
+	Promiscuous          bool   // run in promiscuous mode, to see the traffic not for this host (iftop only)
+	Zones                *Zones // classifies the flow ends, nil means DefaultZones
 	useTextMode          bool   // use text interface without ncurses
 }
 
@@ -29,6 +34,16 @@ func (options *Options) Valid() (err error) {
 		return fmt.Errorf("interface name is required")
 	}
 
+	if err := ValidFilter(options.Filter); err != nil {
+		return err
+	}
+	if err := ValidNetFilter(options.NetFilter, false); err != nil {
+		return err
+	}
+	if err := ValidNetFilter(options.NetFilter6, true); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -51,6 +66,22 @@ func getArguments(options Options) []string {
 		arguments = append(arguments, "-P")
 	}
 
+	if options.Filter != "" {
+		arguments = append(arguments, "-f", options.Filter)
+	}
+
+	if options.NetFilter != "" {
+		arguments = append(arguments, "-F", options.NetFilter)
+	}
+
+	if options.NetFilter6 != "" {
+		arguments = append(arguments, "-G", options.NetFilter6)
+	}
+
+	if options.Promiscuous {
+		arguments = append(arguments, "-p")
+	}
+
 	if options.SortBy != "" {
 		arguments = append(arguments, "-o", string(options.SortBy))
 	}
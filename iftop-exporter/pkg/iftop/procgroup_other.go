@@ -0,0 +1,20 @@
+//go:build !unix
+
+package iftop
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup kills the process, the process groups are not supported on this platform.
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
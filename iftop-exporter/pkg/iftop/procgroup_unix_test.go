@@ -0,0 +1,103 @@
+//go:build unix
+
+package iftop
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskTerminate(t *testing.T) {
+	task := NewTask(Options{InterfaceName: "eth0"})
+
+	// the shell and its child ignore SIGTERM, and the child keeps the stdout open,
+	// so Run only returns if SIGKILL reaches the whole process group.
+	task.iftop.cmd = exec.Command("sh", "-c", `trap "" TERM; sleep 30 & wait`)
+	setProcessGroup(task.iftop.cmd)
+
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- task.Run()
+	}()
+
+	assert.Eventually(t, func() bool {
+		task.lock.Lock()
+		defer task.lock.Unlock()
+		return task.iftop.cmd.Process != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	// give the shell time to set up the trap
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	assert.NoError(t, task.Terminate(200*time.Millisecond))
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "SIGTERM is ignored, SIGKILL is sent after timeout")
+
+	select {
+	case err := <-runErrCh:
+		assert.Error(t, err, "killed by signal")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Terminate")
+	}
+
+	// terminating an exited or a never started task returns at once
+	assert.NoError(t, task.Terminate(time.Second))
+	assert.NoError(t, NewTask(Options{InterfaceName: "eth0"}).Terminate(time.Second))
+}
+
+func TestTaskRunContext(t *testing.T) {
+	task := NewTask(Options{InterfaceName: "eth0"})
+	// the child keeps the stdout open, so RunContext only returns if the whole process group is killed
+	task.iftop.cmd = exec.Command("sh", "-c", `sleep 30 & wait`)
+	setProcessGroup(task.iftop.cmd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- task.RunContext(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-runErrCh:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext did not return after cancel")
+	}
+
+	// a cancelled context does not start the process
+	task = NewTask(Options{InterfaceName: "eth0"})
+	assert.ErrorIs(t, task.RunContext(ctx), context.Canceled)
+	assert.Nil(t, task.iftop.cmd.Process)
+}
+
+func TestTaskHangWatchdog(t *testing.T) {
+	task := NewTask(Options{InterfaceName: "eth0"}).WithHangTimeout(300 * time.Millisecond)
+	// prints for a while, then wedges
+	task.iftop.cmd = exec.Command("sh", "-c", `for i in 1 2 3; do echo line; sleep 0.1; done; sleep 30 & wait`)
+	setProcessGroup(task.iftop.cmd)
+
+	start := time.Now()
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- task.Run()
+	}()
+
+	select {
+	case err := <-runErrCh:
+		assert.ErrorIs(t, err, ErrHang)
+		assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond, "the output resets the watchdog")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hung run is not killed")
+	}
+
+	// a run which keeps printing is not killed
+	task = NewTask(Options{InterfaceName: "eth0"}).WithHangTimeout(300 * time.Millisecond)
+	task.iftop.cmd = exec.Command("sh", "-c", `for i in 1 2 3 4 5 6; do echo line; sleep 0.1; done`)
+	assert.NoError(t, task.Run())
+}
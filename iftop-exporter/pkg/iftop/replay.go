@@ -0,0 +1,178 @@
+package iftop
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ReplayStdoutSuffix is the file suffix of the recorded iftop stdout of an interface.
+	ReplayStdoutSuffix = ".stdout"
+	// ReplayStderrSuffix is the file suffix of the recorded iftop stderr of an interface.
+	ReplayStderrSuffix = ".stderr"
+
+	// textModeRoundDuration is how often iftop prints a round in text mode without `-s`.
+	textModeRoundDuration = 2 * time.Second
+)
+
+// Replay feeds previously recorded iftop outputs through the same parser as a live Task.
+//
+// The replay directory contains `{interface}.stdout` and optionally `{interface}.stderr` files.
+// Each round is released after the time iftop would have taken to print it
+// (options.SingleSeconds if set, otherwise 2 seconds), divided by speed.
+type Replay struct {
+	task       *Task
+	stdoutPath string
+	stderrPath string
+	speed      float64
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// NewReplay creates a replay of the recorded outputs of options.InterfaceName under dir.
+//
+// A speed of 1 keeps the original pacing, 10 replays ten times faster,
+// and 0 (or negative) replays without waiting.
+func NewReplay(options Options, dir string, speed float64) *Replay {
+	return &Replay{
+		task:       NewTask(options),
+		stdoutPath: filepath.Join(dir, options.InterfaceName+ReplayStdoutSuffix),
+		stderrPath: filepath.Join(dir, options.InterfaceName+ReplayStderrSuffix),
+		speed:      speed,
+		stopCh:     make(chan struct{}),
+	}
+}
+
+// ReplayInterfaces returns the names of the interfaces which have a recorded stdout file under dir.
+func ReplayInterfaces(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read replay dir (%s) failed, err: %s", dir, err)
+	}
+
+	interfaceNames := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if name, ok := strings.CutSuffix(entry.Name(), ReplayStdoutSuffix); ok && name != "" {
+			interfaceNames = append(interfaceNames, name)
+		}
+	}
+	sort.Strings(interfaceNames)
+
+	return interfaceNames, nil
+}
+
+func (replay *Replay) ID() string {
+	return replay.task.ID()
+}
+
+func (replay *Replay) State() State {
+	return replay.task.State()
+}
+
+// Stop interrupts the replay, Run returns before releasing the next round.
+func (replay *Replay) Stop() error {
+	replay.stopOnce.Do(func() {
+		close(replay.stopCh)
+	})
+	return nil
+}
+
+// Run replays the recorded stderr at once, then the recorded stdout round by round.
+func (replay *Replay) Run() error {
+	return replay.RunContext(context.Background())
+}
+
+// RunContext is like Run, but stops the replay when ctx is done.
+func (replay *Replay) RunContext(ctx context.Context) error {
+	stopReplay := context.AfterFunc(ctx, func() {
+		replay.Stop()
+	})
+	defer stopReplay()
+
+	replay.task.runStart = time.Now()
+	replay.task.setInfo(func(state *State) {
+		state.RunStart = replay.task.runStart
+	})
+
+	if stderr, err := os.Open(replay.stderrPath); err == nil {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		replay.task.processStderr(&wg, stderr)
+		stderr.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("open replay stderr file failed, err: %s", err)
+	}
+
+	stdout, err := os.Open(replay.stdoutPath)
+	if err != nil {
+		return fmt.Errorf("open replay stdout file failed, err: %s", err)
+	}
+	defer stdout.Close()
+
+	roundDuration := textModeRoundDuration
+	if replay.task.iftop.options.SingleSeconds > 0 {
+		roundDuration = time.Duration(replay.task.iftop.options.SingleSeconds) * time.Second
+	}
+
+	// lines of the round being read, they are processed together when the round ends
+	round := []string{}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		line := removeAllEscape(strings.TrimSpace(scanner.Text()))
+		round = append(round, line)
+
+		// the `=====` line is printed after the "Cumulative" line and ends a round
+		if !strings.HasPrefix(line, "=") {
+			continue
+		}
+
+		if !replay.wait(roundDuration) {
+			return nil
+		}
+		for _, l := range round {
+			replay.task.processStdoutLine(l)
+		}
+		round = round[:0]
+	}
+
+	// an incomplete last round (e.g. iftop was killed) is processed without waiting
+	for _, l := range round {
+		replay.task.processStdoutLine(l)
+	}
+
+	return scanner.Err()
+}
+
+// wait sleeps for the scaled round duration, it returns false if the replay is stopped.
+func (replay *Replay) wait(roundDuration time.Duration) bool {
+	select {
+	case <-replay.stopCh:
+		return false
+	default:
+	}
+
+	if replay.speed <= 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(time.Duration(float64(roundDuration) / replay.speed)):
+		return true
+	case <-replay.stopCh:
+		return false
+	}
+}
@@ -0,0 +1,72 @@
+package iftop
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	stderr := `interface: eno2
+IP address is: 10.0.10.201
+MAC address is: d4:5d:64:bc:bd:4c
+`
+	stdout := `   # Host name (port/service if enabled)            last 2s   last 10s   last 40s cumulative
+--------------------------------------------------------------------------------------------
+   1 10.0.10.201                              =>     7.52Kb     7.52Kb     7.52Kb     1.88KB
+     10.0.10.204                              <=     7.19Mb     7.19Mb     7.19Mb     1.80MB
+--------------------------------------------------------------------------------------------
+Total send rate:                                     7.52Kb     7.52Kb     7.52Kb
+Total receive rate:                                  7.19Mb     7.19Mb     7.19Mb
+Total send and receive rate:                         7.20Mb     7.20Mb     7.20Mb
+--------------------------------------------------------------------------------------------
+Peak rate (sent/received/total):                     7.52Kb     7.19Mb     7.20Mb
+Cumulative (sent/received/total):                    1.88KB     1.80MB     1.80MB
+============================================================================================
+
+   # Host name (port/service if enabled)            last 2s   last 10s   last 40s cumulative
+--------------------------------------------------------------------------------------------
+   1 10.0.10.201                              =>     4.27Kb     4.88Kb     4.88Kb     4.88KB
+     10.0.10.204                              <=     5.70Mb     6.55Mb     6.55Mb     6.55MB
+--------------------------------------------------------------------------------------------
+Total send rate:                                     4.27Kb     4.88Kb     4.88Kb
+Total receive rate:                                  5.70Mb     6.55Mb     6.55Mb
+Total send and receive rate:                         5.70Mb     6.55Mb     6.55Mb
+--------------------------------------------------------------------------------------------
+Peak rate (sent/received/total):                     7.52Kb     7.19Mb     7.20Mb
+Cumulative (sent/received/total):                    4.88KB     6.55MB     6.55MB
+============================================================================================
+`
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "eno2"+ReplayStdoutSuffix), []byte(stdout), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "eno2"+ReplayStderrSuffix), []byte(stderr), 0644))
+
+	interfaceNames, err := ReplayInterfaces(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eno2"}, interfaceNames)
+
+	replay := NewReplay(Options{InterfaceName: "eno2"}, dir, 0)
+	require.NoError(t, replay.Run())
+
+	state := replay.State()
+	assert.Equal(t, "eno2", state.Interface)
+	assert.Equal(t, "10.0.10.201", state.IP)
+	require.NotNil(t, state.FlowStats)
+
+	// the state holds the last round
+	flow := state.FlowStats.Flows[0]
+	assert.Equal(t, "10.0.10.201", flow.Src)
+	assert.Equal(t, "10.0.10.204", flow.Dst)
+	assert.Equal(t, 4.27*1024, flow.Last2RateBits)
+	assert.Equal(t, 6.55*1024*1024, state.FlowStats.CumulativeRecvBytes)
+
+	// a stopped replay does not release any round
+	stopped := NewReplay(Options{InterfaceName: "eno2"}, dir, 1)
+	stopped.Stop()
+	require.NoError(t, stopped.Run())
+	assert.Nil(t, stopped.State().FlowStats)
+}
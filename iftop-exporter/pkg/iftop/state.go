@@ -1,10 +1,11 @@
 package iftop
 
 import (
-	"net"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bougou/go-unit"
 )
@@ -19,12 +20,28 @@ var (
 	flowInMatcher = regexp.MustCompile(flowInPattern)
 )
 
+// State is an immutable snapshot of a run, it is published when a round completes.
+// The FlowStats and the Flows must not be modified by the readers.
 type State struct {
 	Interface string     `json:"interface"`
 	IP        string     `json:"ip"`
 	IPv6      string     `json:"ipv6"`
 	MAC       string     `json:"mac"`
 	FlowStats *FlowStats `json:"flow_stats"`
+
+	// Round is the sequence number of the completed round in the run, starting from 1,
+	// zero means no round has completed yet.
+	Round uint64 `json:"round"`
+	// RoundStart is when the previous round ended (or the run started for the first round),
+	// RoundEnd is when this round ended, so they bound the time the round covers.
+	RoundStart time.Time `json:"round_start"`
+	RoundEnd   time.Time `json:"round_end"`
+	// RunStart is when the run started, it is the same for all rounds of a run.
+	RunStart time.Time `json:"run_start"`
+	// RunDuration is how long the run had been running when this round ended.
+	RunDuration time.Duration `json:"run_duration"`
+	// UnmatchedLines is the number of the stdout lines of the run which could not be parsed so far.
+	UnmatchedLines uint64 `json:"unmatched_lines"`
 }
 
 type FlowStats struct {
@@ -59,19 +76,18 @@ const (
 	FlowDirectionX   FlowDirection = "x"   // src <=> dst (in and out)
 )
 
-type FlowType string
-
-const (
-	FlowTypePublic  FlowType = "public"
-	FlowTypePrivate FlowType = "private"
-)
-
 type Flow struct {
 	Index     int
 	Src       string
 	Dst       string
 	Direction FlowDirection
-	Type      FlowType
+	// SrcPort and DstPort are the ports (or the services) of the flow ends, they are empty unless Options.ShowPort is set,
+	// then Src and Dst hold the hosts only.
+	SrcPort string
+	DstPort string
+	// SrcZone and DstZone are the zones of the flow ends, see Zones.
+	SrcZone string
+	DstZone string
 
 	Last2RateBits   float64 // unit: bits per second
 	Last10RateBits  float64 // unit: bits per second
@@ -79,6 +95,62 @@ type Flow struct {
 	CumulativeBytes float64 // unit: Bytes
 }
 
+// SumFlows returns the "all" flows which sum up the specified flows by direction and zone pair,
+// sorted by direction, src zone and dst zone.
+//
+// The flows with src "all" are sum flows themselves and are skipped.
+func SumFlows(flows []*Flow) []*Flow {
+	type sumKey struct {
+		direction FlowDirection
+		srcZone   string
+		dstZone   string
+	}
+
+	sumFlows := []*Flow{}
+	index := map[sumKey]*Flow{}
+
+	for _, flow := range flows {
+		if flow == nil || flow.Src == "all" {
+			continue
+		}
+		if flow.Direction != FlowDirectionIn && flow.Direction != FlowDirectionOut {
+			continue
+		}
+
+		key := sumKey{flow.Direction, flow.SrcZone, flow.DstZone}
+		sumFlow, ok := index[key]
+		if !ok {
+			sumFlow = &Flow{
+				Src:       "all",
+				Dst:       "all",
+				Direction: flow.Direction,
+				SrcZone:   flow.SrcZone,
+				DstZone:   flow.DstZone,
+			}
+			index[key] = sumFlow
+			sumFlows = append(sumFlows, sumFlow)
+		}
+
+		sumFlow.Last2RateBits += flow.Last2RateBits
+		sumFlow.Last10RateBits += flow.Last10RateBits
+		sumFlow.Last40RateBits += flow.Last40RateBits
+		sumFlow.CumulativeBytes += flow.CumulativeBytes
+	}
+
+	sort.Slice(sumFlows, func(i, j int) bool {
+		a, b := sumFlows[i], sumFlows[j]
+		if a.Direction != b.Direction {
+			return a.Direction < b.Direction
+		}
+		if a.SrcZone != b.SrcZone {
+			return a.SrcZone < b.SrcZone
+		}
+		return a.DstZone < b.DstZone
+	})
+
+	return sumFlows
+}
+
 func (task *Task) processStderrLine(line string) {
 	line = strings.TrimSpace(line)
 	if line == "" {
@@ -91,27 +163,35 @@ func (task *Task) processStderrLine(line string) {
 
 	if strings.HasPrefix(line, "interface:") {
 		interfaceName, _ := strings.CutPrefix(line, "interface:")
-		task.state.Interface = strings.TrimSpace(interfaceName)
+		task.setInfo(func(state *State) { state.Interface = strings.TrimSpace(interfaceName) })
 		return
 	}
 
 	if strings.HasPrefix(line, "IP address is:") {
 		ipv4, _ := strings.CutPrefix(line, "IP address is:")
-		task.state.IP = strings.TrimSpace(ipv4)
+		task.setInfo(func(state *State) { state.IP = strings.TrimSpace(ipv4) })
 		return
 	}
 
 	if strings.HasPrefix(line, "IPv6 address is:") {
 		ipv6, _ := strings.CutPrefix(line, "IPv6 address is:")
-		task.state.IPv6 = strings.TrimSpace(ipv6)
+		task.setInfo(func(state *State) { state.IPv6 = strings.TrimSpace(ipv6) })
 		return
 	}
 
 	if strings.HasPrefix(line, "MAC address is:") {
 		mac, _ := strings.CutPrefix(line, "MAC address is:")
-		task.state.MAC = strings.TrimSpace(mac)
+		task.setInfo(func(state *State) { state.MAC = strings.TrimSpace(mac) })
 		return
 	}
+
+	if kind := matchStderrError(line); kind != nil {
+		task.lock.Lock()
+		if task.stderrErr == nil {
+			task.stderrErr = &RunError{Kind: kind, Message: line}
+		}
+		task.lock.Unlock()
+	}
 }
 
 func (task *Task) processStdoutLine(line string) {
@@ -127,11 +207,13 @@ func (task *Task) processStdoutLine(line string) {
 	if strings.Contains(line, "=>") {
 		m, matched := GetNamedCapturingGroupMap(flowOutMatcher, line)
 		if !matched {
+			task.unmatchedLines.Add(1)
 			return
 		}
 
 		index, err := strconv.Atoi(m["Index"])
 		if err != nil {
+			task.unmatchedLines.Add(1)
 			return
 		}
 
@@ -149,60 +231,19 @@ func (task *Task) processStdoutLine(line string) {
 			task.processingFlowStats = &FlowStats{
 				Flows: make([]*Flow, 0),
 			}
-
-			// init sum flows
-			task.sumPrivateInFlow = &Flow{
-				Src:             "all",
-				Dst:             "all",
-				Direction:       FlowDirectionIn,
-				Type:            FlowTypePrivate,
-				Last2RateBits:   0,
-				Last10RateBits:  0,
-				Last40RateBits:  0,
-				CumulativeBytes: 0,
-			}
-			task.sumPrivateOutFlow = &Flow{
-				Src:             "all",
-				Dst:             "all",
-				Direction:       FlowDirectionOut,
-				Type:            FlowTypePrivate,
-				Last2RateBits:   0,
-				Last10RateBits:  0,
-				Last40RateBits:  0,
-				CumulativeBytes: 0,
-			}
-			task.sumPublicInFlow = &Flow{
-				Src:             "all",
-				Dst:             "all",
-				Direction:       FlowDirectionIn,
-				Type:            FlowTypePublic,
-				Last2RateBits:   0,
-				Last10RateBits:  0,
-				Last40RateBits:  0,
-				CumulativeBytes: 0,
-			}
-			task.sumPublicOutFlow = &Flow{
-				Src:             "all",
-				Dst:             "all",
-				Direction:       FlowDirectionOut,
-				Type:            FlowTypePublic,
-				Last2RateBits:   0,
-				Last10RateBits:  0,
-				Last40RateBits:  0,
-				CumulativeBytes: 0,
-			}
 		}
 
 		if !task.flowIndex1Found {
 			return
 		}
 
+		src, srcPort := task.splitAddr(m["Addr"])
 		task.processingIndex = index
 		task.processingOutFlow = &Flow{
 			Index:           index,
-			Src:             m["Addr"],
+			Src:             src,
+			SrcPort:         srcPort,
 			Direction:       FlowDirectionOut,
-			Type:            FlowTypePublic,
 			Last2RateBits:   parseValueToBits(m["Last2"]),
 			Last10RateBits:  parseValueToBits(m["Last10"]),
 			Last40RateBits:  parseValueToBits(m["Last40"]),
@@ -226,6 +267,7 @@ func (task *Task) processStdoutLine(line string) {
 
 		m, matched := GetNamedCapturingGroupMap(flowInMatcher, line)
 		if !matched {
+			task.unmatchedLines.Add(1)
 			return
 		}
 
@@ -233,47 +275,23 @@ func (task *Task) processStdoutLine(line string) {
 		if outFlow == nil {
 			return
 		}
-		outFlow.Dst = m["Addr"]
+		outFlow.Dst, outFlow.DstPort = task.splitAddr(m["Addr"])
 
 		inFlow := &Flow{
 			Index:           outFlow.Index,
 			Src:             outFlow.Src,
-			Dst:             m["Addr"],
+			Dst:             outFlow.Dst,
+			SrcPort:         outFlow.SrcPort,
+			DstPort:         outFlow.DstPort,
 			Direction:       FlowDirectionIn,
-			Type:            FlowTypePublic,
 			Last2RateBits:   parseValueToBits(m["Last2"]),
 			Last10RateBits:  parseValueToBits(m["Last10"]),
 			Last40RateBits:  parseValueToBits(m["Last40"]),
 			CumulativeBytes: parseValueToBits(m["Cumulative"]) / 8,
 		}
 
-		srcIP := extractIP(outFlow.Src)
-		dstIP := extractIP(outFlow.Dst)
-		if net.ParseIP(srcIP).IsPrivate() && net.ParseIP(dstIP).IsPrivate() {
-			outFlow.Type = FlowTypePrivate
-			task.sumPrivateOutFlow.Last2RateBits += outFlow.Last2RateBits
-			task.sumPrivateOutFlow.Last10RateBits += outFlow.Last10RateBits
-			task.sumPrivateOutFlow.Last40RateBits += outFlow.Last40RateBits
-			task.sumPrivateOutFlow.CumulativeBytes += outFlow.CumulativeBytes
-
-			inFlow.Type = FlowTypePrivate
-			task.sumPrivateInFlow.Last2RateBits += inFlow.Last2RateBits
-			task.sumPrivateInFlow.Last10RateBits += inFlow.Last10RateBits
-			task.sumPrivateInFlow.Last40RateBits += inFlow.Last40RateBits
-			task.sumPrivateInFlow.CumulativeBytes += inFlow.CumulativeBytes
-		} else {
-			outFlow.Type = FlowTypePublic
-			task.sumPublicOutFlow.Last2RateBits += outFlow.Last2RateBits
-			task.sumPublicOutFlow.Last10RateBits += outFlow.Last10RateBits
-			task.sumPublicOutFlow.Last40RateBits += outFlow.Last40RateBits
-			task.sumPublicOutFlow.CumulativeBytes += outFlow.CumulativeBytes
-
-			inFlow.Type = FlowTypePublic
-			task.sumPublicInFlow.Last2RateBits += inFlow.Last2RateBits
-			task.sumPublicInFlow.Last10RateBits += inFlow.Last10RateBits
-			task.sumPublicInFlow.Last40RateBits += inFlow.Last40RateBits
-			task.sumPublicInFlow.CumulativeBytes += inFlow.CumulativeBytes
-		}
+		task.iftop.options.Zones.ClassifyFlow(outFlow)
+		task.iftop.options.Zones.ClassifyFlow(inFlow)
 
 		if task.processingFlowStats != nil {
 			task.processingFlowStats.Flows = append(task.processingFlowStats.Flows, outFlow, inFlow)
@@ -287,12 +305,13 @@ func (task *Task) processStdoutLine(line string) {
 		words := strings.Fields(strings.TrimSpace(line))
 
 		if len(words) != 3 {
+			task.unmatchedLines.Add(1)
 			return
 		}
-		if task.processingFlowStats != nil {
-			task.processingFlowStats.TotalSentLast2RateBits = parseValueToBits(words[0])
-			task.processingFlowStats.TotalSentLast10RateBits = parseValueToBits(words[1])
-			task.processingFlowStats.TotalSentLast40RateBits = parseValueToBits(words[2])
+		if flowStats := task.roundFlowStats(); flowStats != nil {
+			flowStats.TotalSentLast2RateBits = parseValueToBits(words[0])
+			flowStats.TotalSentLast10RateBits = parseValueToBits(words[1])
+			flowStats.TotalSentLast40RateBits = parseValueToBits(words[2])
 		}
 		return
 	}
@@ -303,12 +322,13 @@ func (task *Task) processStdoutLine(line string) {
 		words := strings.Fields(strings.TrimSpace(line))
 
 		if len(words) != 3 {
+			task.unmatchedLines.Add(1)
 			return
 		}
-		if task.processingFlowStats != nil {
-			task.processingFlowStats.TotalRecvLast2RateBits = parseValueToBits(words[0])
-			task.processingFlowStats.TotalRecvLast10RateBits = parseValueToBits(words[1])
-			task.processingFlowStats.TotalRecvLast40RateBits = parseValueToBits(words[2])
+		if flowStats := task.roundFlowStats(); flowStats != nil {
+			flowStats.TotalRecvLast2RateBits = parseValueToBits(words[0])
+			flowStats.TotalRecvLast10RateBits = parseValueToBits(words[1])
+			flowStats.TotalRecvLast40RateBits = parseValueToBits(words[2])
 		}
 
 		return
@@ -319,12 +339,13 @@ func (task *Task) processStdoutLine(line string) {
 		line = strings.TrimSpace(line)
 		words := strings.Fields(strings.TrimSpace(line))
 		if len(words) != 3 {
+			task.unmatchedLines.Add(1)
 			return
 		}
-		if task.processingFlowStats != nil {
-			task.processingFlowStats.TotalSentAndRecvLast2RateBits = parseValueToBits(words[0])
-			task.processingFlowStats.TotalSentAndRecvLast10RateBits = parseValueToBits(words[1])
-			task.processingFlowStats.TotalSentAndRecvLast40RateBits = parseValueToBits(words[2])
+		if flowStats := task.roundFlowStats(); flowStats != nil {
+			flowStats.TotalSentAndRecvLast2RateBits = parseValueToBits(words[0])
+			flowStats.TotalSentAndRecvLast10RateBits = parseValueToBits(words[1])
+			flowStats.TotalSentAndRecvLast40RateBits = parseValueToBits(words[2])
 		}
 		return
 	}
@@ -335,12 +356,13 @@ func (task *Task) processStdoutLine(line string) {
 		words := strings.Fields(strings.TrimSpace(line))
 
 		if len(words) != 3 {
+			task.unmatchedLines.Add(1)
 			return
 		}
-		if task.processingFlowStats != nil {
-			task.processingFlowStats.PeakSentRateBits = parseValueToBits(words[0])
-			task.processingFlowStats.PeakRecvRateBits = parseValueToBits(words[1])
-			task.processingFlowStats.PeakSentAndRecvRateBits = parseValueToBits(words[2])
+		if flowStats := task.roundFlowStats(); flowStats != nil {
+			flowStats.PeakSentRateBits = parseValueToBits(words[0])
+			flowStats.PeakRecvRateBits = parseValueToBits(words[1])
+			flowStats.PeakSentAndRecvRateBits = parseValueToBits(words[2])
 		}
 		return
 	}
@@ -351,27 +373,50 @@ func (task *Task) processStdoutLine(line string) {
 		words := strings.Fields(strings.TrimSpace(line))
 
 		if len(words) != 3 {
+			task.unmatchedLines.Add(1)
 			return
 		}
-		if task.processingFlowStats != nil {
-			task.processingFlowStats.CumulativeSentBytes = parseValueToBits(words[0]) / 8
-			task.processingFlowStats.CumulativeRecvBytes = parseValueToBits(words[1]) / 8
-			task.processingFlowStats.CumulativeSentAndRecvBytes = parseValueToBits(words[2]) / 8
-
-			if len(task.processingFlowStats.Flows) > 0 {
-				task.processingFlowStats.Flows = append(task.processingFlowStats.Flows,
-					task.sumPrivateInFlow,
-					task.sumPrivateOutFlow,
-					task.sumPublicInFlow,
-					task.sumPublicOutFlow)
+		if flowStats := task.roundFlowStats(); flowStats != nil {
+			flowStats.CumulativeSentBytes = parseValueToBits(words[0]) / 8
+			flowStats.CumulativeRecvBytes = parseValueToBits(words[1]) / 8
+			flowStats.CumulativeSentAndRecvBytes = parseValueToBits(words[2]) / 8
+
+			if len(flowStats.Flows) > 0 {
+				flowStats.Flows = append(flowStats.Flows, SumFlows(flowStats.Flows)...)
 			}
 		}
 
-		// Now, the process for this round finished, saving the flowStats.
-		task.state.FlowStats = task.processingFlowStats
+		// Now, the process for this round finished, publishing the flowStats.
+		// The published flowStats is never touched again, the next round starts a new one.
+		task.publish(task.processingFlowStats)
+		task.processingFlowStats = nil
+		return
+	}
+
+	if strings.HasPrefix(line, "Listening on") {
 		return
 	}
 
+	task.unmatchedLines.Add(1)
+}
+
+// roundFlowStats returns the flowStats of the round in process, a round without flows starts a new one at its totals.
+// It returns nil until the index-1 flow of the first round is found.
+func (task *Task) roundFlowStats() *FlowStats {
+	if task.processingFlowStats == nil && task.flowIndex1Found {
+		task.processingFlowStats = &FlowStats{
+			Flows: make([]*Flow, 0),
+		}
+	}
+	return task.processingFlowStats
+}
+
+// splitAddr splits the address of a flow end into the host and the port if iftop shows the ports.
+func (task *Task) splitAddr(addr string) (host string, port string) {
+	if !task.iftop.options.ShowPort {
+		return addr, ""
+	}
+	return splitHostPort(addr)
 }
 
 func parseValueToBits(value string) (bits float64) {
@@ -3,26 +3,59 @@ package iftop
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// ErrHang is returned by RunContext if the run is killed for producing no output, see WithHangTimeout.
+var ErrHang = errors.New("iftop hangs")
+
 type Task struct {
-	iftop               *Command
-	state               *State
-	log                 *Log
+	iftop *Command
+
+	// lock protects info and the process lifecycle (stopped and the started command).
+	lock    sync.Mutex
+	info    State // interface information parsed from stderr
+	stopped bool
+	// stderrErr is the first known error message found in stderr, see matchStderrError.
+	stderrErr *RunError
+	// exited is closed when the started process exited and its outputs are processed.
+	exited chan struct{}
+
+	// state is the snapshot published by the latest completed round.
+	state atomic.Pointer[State]
+
+	// unmatchedLines counts the stdout lines which could not be parsed.
+	unmatchedLines atomic.Uint64
+
+	// hangTimeout is how long a run may produce no output before it is killed, zero means no watchdog.
+	hangTimeout time.Duration
+	// lastOutput is the unix nano time of the latest stdout or stderr line.
+	lastOutput atomic.Int64
+
+	// the following fields are only accessed by the stdout goroutine
+	runStart     time.Time
+	round        uint64
+	lastRoundEnd time.Time
+
+	log *Log
+	// openRecorder opens the recorder of the run when the run starts, see WithRecorder.
+	openRecorder func() (OutputRecorder, error)
+	// recorder is the opened recorder of the run, it is nil before the run starts.
+	recorder            OutputRecorder
 	flowIndex1Found     bool
 	processingIndex     int
 	processingOutFlow   *Flow
 	processingFlowStats *FlowStats
-	sumPrivateInFlow    *Flow
-	sumPrivateOutFlow   *Flow
-	sumPublicInFlow     *Flow
-	sumPublicOutFlow    *Flow
 }
 
 // Log contains raw stderr and stdout outputs
@@ -31,43 +64,134 @@ type Log struct {
 	Stdout string `json:"stdout"`
 }
 
+// OutputRecorder receives the raw stderr and stdout outputs of a run.
+type OutputRecorder interface {
+	Stdout() io.Writer
+	Stderr() io.Writer
+	// Close is called after the run exits and all the outputs are written.
+	Close() error
+}
+
 func NewTask(options Options) *Task {
 	// useTextMode should always be true
 	options.useTextMode = true
 
 	return &Task{
-		iftop: NewIftop(options),
-		state: &State{},
-		log:   &Log{},
+		iftop:  NewIftop(options),
+		log:    &Log{},
+		exited: make(chan struct{}),
 	}
 }
 
-// State returns information about progress task
-func (task Task) State() State {
-	return *task.state
+// WithRecorder records the raw outputs of the run with the recorder returned by open.
+// The recorder is opened when the run starts, and closed after it exits, a task which never runs opens nothing.
+// The run is not recorded if open fails.
+func (task *Task) WithRecorder(open func() (OutputRecorder, error)) *Task {
+	task.openRecorder = open
+	return task
+}
+
+// WithHangTimeout kills the run if it produces no output for longer than timeout,
+// e.g. iftop occasionally wedges on opening the pcap.
+func (task *Task) WithHangTimeout(timeout time.Duration) *Task {
+	task.hangTimeout = timeout
+	return task
+}
+
+// State returns the snapshot published by the latest completed round.
+// Before any round completes, it only contains the interface information.
+// The UnmatchedLines is always up to date.
+func (task *Task) State() State {
+	var state State
+	if published := task.state.Load(); published != nil {
+		state = *published
+	} else {
+		task.lock.Lock()
+		state = task.info
+		task.lock.Unlock()
+	}
+
+	state.UnmatchedLines = task.unmatchedLines.Load()
+	return state
+}
+
+// setInfo updates the interface information parsed from stderr.
+func (task *Task) setInfo(update func(state *State)) {
+	task.lock.Lock()
+	defer task.lock.Unlock()
+	update(&task.info)
+}
+
+// publish atomically replaces the snapshot with the flowStats of the completed round.
+func (task *Task) publish(flowStats *FlowStats) {
+	now := time.Now()
+
+	task.round++
+	roundStart := task.lastRoundEnd
+	if roundStart.IsZero() {
+		roundStart = task.runStart
+	}
+	task.lastRoundEnd = now
+
+	task.lock.Lock()
+	state := task.info
+	task.lock.Unlock()
+
+	state.FlowStats = flowStats
+	state.Round = task.round
+	state.RoundStart = roundStart
+	state.RoundEnd = now
+	state.RunStart = task.runStart
+	if !task.runStart.IsZero() {
+		state.RunDuration = now.Sub(task.runStart)
+	}
+
+	task.state.Store(&state)
 }
 
 // Log return structure which contains raw stderr and stdout outputs
-func (task Task) Log() Log {
+func (task *Task) Log() Log {
 	return Log{
 		Stderr: task.log.Stderr,
 		Stdout: task.log.Stdout,
 	}
 }
 
-func (task Task) ID() string {
+func (task *Task) ID() string {
 	return task.iftop.options.InterfaceName
 }
 
 // String return the actual exec cmd string of the task
-func (task Task) String() string {
+func (task *Task) String() string {
 	return task.iftop.cmd.String()
 }
 
 // Run starts and waits the program until exit, and also process stdout/stderr in other go-routines.
 func (task *Task) Run() error {
+	return task.RunContext(context.Background())
+}
+
+// RunContext is like Run, but kills the process group of iftop when ctx is done.
+// It returns ctx.Err() if the run is cancelled, ErrHang if the run is killed by the hang watchdog,
+// and a *RunError if the run failed with a known error message in stderr.
+func (task *Task) RunContext(ctx context.Context) error {
 	var err error
 
+	// a bad option fails at once, instead of a run which exits with an unclear error,
+	// it is checked before the recorder is opened, so the rejected run leaves no record behind
+	if err := task.iftop.options.Valid(); err != nil {
+		return err
+	}
+
+	if task.openRecorder != nil {
+		// the run is not recorded if the recorder fails to open, the caller of WithRecorder reports it
+		if recorder, err := task.openRecorder(); err == nil {
+			task.recorder = recorder
+			// deferred, so it is closed after the stdout/stderr goroutines finished writing.
+			defer recorder.Close()
+		}
+	}
+
 	// The pipe would be auto closed by `Wait`, so the caller that uses the pipe does not need to close it.
 	stderr, err := task.iftop.StderrPipe()
 	if err != nil {
@@ -81,20 +205,146 @@ func (task *Task) Run() error {
 	}
 	defer stdout.Close()
 
+	task.lock.Lock()
+	if task.stopped {
+		task.lock.Unlock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		task.lock.Unlock()
+		return err
+	}
+	task.runStart = time.Now()
+	task.info.RunStart = task.runStart
+	task.lastOutput.Store(task.runStart.UnixNano())
+	if err := task.iftop.Start(); err != nil {
+		task.lock.Unlock()
+		if errors.Is(err, exec.ErrNotFound) {
+			return &RunError{Kind: ErrBinaryNotFound, Err: err}
+		}
+		return err
+	}
+	task.lock.Unlock()
+	defer close(task.exited)
+
+	stopCancel := context.AfterFunc(ctx, func() {
+		task.signal(syscall.SIGKILL)
+	})
+	defer stopCancel()
+
+	var hung atomic.Bool
+	watchdogDone := make(chan struct{})
+	watchdogExited := make(chan struct{})
+	if task.hangTimeout > 0 {
+		go func() {
+			defer close(watchdogExited)
+			task.watchdog(&hung, watchdogDone)
+		}()
+	} else {
+		close(watchdogExited)
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go task.processStdout(&wg, stdout)
 	go task.processStderr(&wg, stderr)
 
-	err = task.iftop.Run()
+	// Wait must be called after all reads from the pipes have completed.
 	wg.Wait()
+	err = task.iftop.Wait()
+
+	close(watchdogDone)
+	<-watchdogExited
+
+	if hung.Load() {
+		return fmt.Errorf("%w, no output for (%s)", ErrHang, task.hangTimeout)
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		task.lock.Lock()
+		stderrErr := task.stderrErr
+		task.lock.Unlock()
+		if stderrErr != nil {
+			return &RunError{Kind: stderrErr.Kind, Message: stderrErr.Message, Err: err}
+		}
+	}
+	return err
+}
+
+// watchdog kills the process group of iftop if there is no output for longer than hangTimeout.
+func (task *Task) watchdog(hung *atomic.Bool, done <-chan struct{}) {
+	ticker := time.NewTicker(max(task.hangTimeout/10, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if time.Since(time.Unix(0, task.lastOutput.Load())) <= task.hangTimeout {
+				continue
+			}
+
+			hung.Store(true)
+			task.signal(syscall.SIGKILL)
+			return
+		}
+	}
+}
 
+// Stop kills the process group of iftop if it has been started, or prevents it from being started.
+func (task *Task) Stop() error {
+	_, err := task.signal(syscall.SIGKILL)
 	return err
 }
 
+// Terminate sends SIGTERM to the process group of iftop, and SIGKILL if it does not exit within timeout.
+// It returns after the process exited, or prevents it from being started.
+func (task *Task) Terminate(timeout time.Duration) error {
+	started, err := task.signal(syscall.SIGTERM)
+	if err != nil || !started {
+		return err
+	}
+
+	select {
+	case <-task.exited:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	if _, err := task.signal(syscall.SIGKILL); err != nil {
+		return err
+	}
+	<-task.exited
+	return nil
+}
+
+// signal marks the task stopped and sends sig to the process group of iftop, started is false if it has not been started.
+func (task *Task) signal(sig syscall.Signal) (started bool, err error) {
+	task.lock.Lock()
+	defer task.lock.Unlock()
+
+	task.stopped = true
+
+	cmd := task.iftop.cmd
+	if cmd == nil || cmd.Process == nil {
+		return false, nil
+	}
+
+	select {
+	case <-task.exited:
+		return true, nil
+	default:
+	}
+
+	return true, signalProcessGroup(cmd, sig)
+}
+
 // GetCmd return the underlying exec.Cmd.
-func (task Task) GetCmd() *exec.Cmd {
+func (task *Task) GetCmd() *exec.Cmd {
 	return task.iftop.cmd
 }
 
@@ -104,8 +354,12 @@ func (task *Task) processStdout(wg *sync.WaitGroup, stdout io.Reader) {
 	scanner := bufio.NewScanner(stdout)
 	scanner.Split(scanProgressLines)
 	for scanner.Scan() {
+		task.lastOutput.Store(time.Now().UnixNano())
 		raw := scanner.Text()
 		// task.log.Stdout += raw + "\n"
+		if task.recorder != nil {
+			io.WriteString(task.recorder.Stdout(), raw+"\n")
+		}
 
 		// the progress output contains escape characters
 		line := removeAllEscape(strings.TrimSpace(raw))
@@ -119,8 +373,12 @@ func (task *Task) processStderr(wg *sync.WaitGroup, stderr io.Reader) {
 
 	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
+		task.lastOutput.Store(time.Now().UnixNano())
 		raw := scanner.Text()
 		// task.log.Stderr += raw + "\n"
+		if task.recorder != nil {
+			io.WriteString(task.recorder.Stderr(), raw+"\n")
+		}
 		// the progress output contains escape characters
 		line := removeAllEscape(strings.TrimSpace(raw))
 		task.processStderrLine(line)
@@ -2,6 +2,8 @@ package iftop
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"sync"
 	"testing"
 
@@ -158,7 +160,12 @@ Cumulative (sent/received/total):                    5.32MB     13.2MB     18.5M
 		wg.Add(1)
 		task.processStdout(&wg, reader)
 
-		flow1 := task.state.FlowStats.Flows[0]
+		state := task.State()
+		// the input contains two rounds
+		assert.Equal(t, uint64(2), state.Round)
+		assert.False(t, state.RoundEnd.Before(state.RoundStart))
+
+		flow1 := state.FlowStats.Flows[0]
 		flow1Expected := tt.expected.FlowStats.Flows[0]
 
 		assert.Equal(t, flow1Expected.Direction, flow1.Direction)
@@ -166,14 +173,14 @@ Cumulative (sent/received/total):                    5.32MB     13.2MB     18.5M
 		assert.Equal(t, flow1Expected.Last10RateBits, flow1.Last10RateBits)
 		assert.Equal(t, flow1Expected.Last40RateBits, flow1.Last40RateBits)
 
-		flow19 := task.state.FlowStats.Flows[18]
+		flow19 := state.FlowStats.Flows[18]
 		flow19Expected := tt.expected.FlowStats.Flows[18]
 		assert.Equal(t, flow19Expected.Direction, flow19.Direction)
 		assert.Equal(t, flow19Expected.Last2RateBits, flow19.Last2RateBits)
 		assert.Equal(t, flow19Expected.Last10RateBits, flow19.Last10RateBits)
 		assert.Equal(t, flow19Expected.Last40RateBits, flow19.Last40RateBits)
 
-		flow20 := task.state.FlowStats.Flows[19]
+		flow20 := state.FlowStats.Flows[19]
 		flow20Expected := tt.expected.FlowStats.Flows[19]
 		assert.Equal(t, flow20Expected.Direction, flow20.Direction)
 		assert.Equal(t, flow20Expected.Last2RateBits, flow20.Last2RateBits)
@@ -183,6 +190,90 @@ Cumulative (sent/received/total):                    5.32MB     13.2MB     18.5M
 
 }
 
+func Test_unmatchedLines(t *testing.T) {
+	input := `
+Listening on eno2
+   # Host name (port/service if enabled)            last 2s   last 10s   last 40s cumulative
+--------------------------------------------------------------------------------------------
+   1 10.0.10.201:36674                        =>     7.52Kb     7.52Kb     7.52Kb     1.88KB
+     10.0.10.204:http                         <=     7.19Mb     7.19Mb     7.19Mb     1.80MB
+   x 10.0.10.201:36675                        =>
+--------------------------------------------------------------------------------------------
+Total send rate:                                     7.10Mb     7.10Mb
+Total receive rate:                                  16.2Mb     16.2Mb     16.2Mb
+Total send and receive rate:                         23.3Mb     23.3Mb     23.3Mb
+something unexpected
+--------------------------------------------------------------------------------------------
+Peak rate (sent/received/total):                     7.10Mb     16.2Mb     23.3Mb
+Cumulative (sent/received/total):                    1.78MB     4.04MB     5.82MB
+============================================================================================
+`
+
+	task := NewTask(Options{InterfaceName: "eno2"})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	task.processStdout(&wg, bytes.NewReader([]byte(input)))
+
+	state := task.State()
+	assert.Equal(t, uint64(1), state.Round)
+	assert.Len(t, state.FlowStats.Flows, 4, "one flow pair and the sum flows of its zone pair")
+	assert.Equal(t, uint64(3), state.UnmatchedLines)
+}
+
+func Test_emptyRound(t *testing.T) {
+	round1 := `
+   1 10.0.10.201:36674                        =>     7.52Kb     7.52Kb     7.52Kb     1.88KB
+     10.0.10.204:http                         <=     7.19Mb     7.19Mb     7.19Mb     1.80MB
+--------------------------------------------------------------------------------------------
+Total send rate:                                     1Kb        1Kb        1Kb
+Total receive rate:                                  1Kb        1Kb        1Kb
+Total send and receive rate:                         2Kb        2Kb        2Kb
+--------------------------------------------------------------------------------------------
+Peak rate (sent/received/total):                     1Kb        1Kb        2Kb
+Cumulative (sent/received/total):                    1.88KB     1.80MB     1.80MB
+============================================================================================
+`
+	round2 := `
+--------------------------------------------------------------------------------------------
+Total send rate:                                     9Kb        9Kb        9Kb
+Total receive rate:                                  9Kb        9Kb        9Kb
+Total send and receive rate:                         18Kb       18Kb       18Kb
+--------------------------------------------------------------------------------------------
+Peak rate (sent/received/total):                     9Kb        9Kb        18Kb
+Cumulative (sent/received/total):                    2KB        2MB        2MB
+============================================================================================
+`
+
+	task := NewTask(Options{InterfaceName: "eno2"})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	task.processStdout(&wg, bytes.NewReader([]byte(round1)))
+	state1 := task.State()
+	assert.Equal(t, uint64(1), state1.Round)
+	assert.Len(t, state1.FlowStats.Flows, 4)
+
+	wg.Add(1)
+	task.processStdout(&wg, bytes.NewReader([]byte(round2)))
+	state2 := task.State()
+	assert.Equal(t, uint64(2), state2.Round)
+	assert.Empty(t, state2.FlowStats.Flows, "no flows and no sum flows")
+	assert.Equal(t, 9216.0, state2.FlowStats.TotalSentLast2RateBits)
+
+	// the snapshot of round 1 is not changed by round 2
+	assert.NotSame(t, state1.FlowStats, state2.FlowStats)
+	assert.Equal(t, 1024.0, state1.FlowStats.TotalSentLast2RateBits)
+	assert.Len(t, state1.FlowStats.Flows, 4)
+	all := 0
+	for _, flow := range state1.FlowStats.Flows {
+		if flow.Src == "all" {
+			all++
+		}
+	}
+	assert.Equal(t, 2, all, "one sum flow per direction")
+}
+
 func Test_removeAllEscape(t *testing.T) {
 
 	tests := []struct {
@@ -202,3 +293,56 @@ func Test_removeAllEscape(t *testing.T) {
 		}
 	}
 }
+
+func Test_showPort(t *testing.T) {
+	input := `
+   # Host name (port/service if enabled)            last 2s   last 10s   last 40s cumulative
+--------------------------------------------------------------------------------------------
+   1 10.0.10.201:36674                        =>     7.52Kb     7.52Kb     7.52Kb     1.88KB
+     10.0.10.204:80                           <=     7.19Mb     7.19Mb     7.19Mb     1.80MB
+--------------------------------------------------------------------------------------------
+Total send rate:                                     7.10Mb     7.10Mb     7.10Mb
+Total receive rate:                                  16.2Mb     16.2Mb     16.2Mb
+Total send and receive rate:                         23.3Mb     23.3Mb     23.3Mb
+--------------------------------------------------------------------------------------------
+Peak rate (sent/received/total):                     7.10Mb     16.2Mb     23.3Mb
+Cumulative (sent/received/total):                    1.78MB     4.04MB     5.82MB
+============================================================================================
+`
+
+	for _, showPort := range []bool{false, true} {
+		task := NewTask(Options{InterfaceName: "eno2", ShowPort: showPort})
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		task.processStdout(&wg, bytes.NewReader([]byte(input)))
+
+		flows := task.State().FlowStats.Flows
+		if !showPort {
+			// the ports stay in the addresses
+			assert.Equal(t, "10.0.10.201:36674", flows[0].Src)
+			assert.Equal(t, "", flows[0].SrcPort)
+			continue
+		}
+
+		for _, flow := range flows[:2] {
+			assert.Equal(t, "10.0.10.201", flow.Src)
+			assert.Equal(t, "36674", flow.SrcPort)
+			assert.Equal(t, "10.0.10.204", flow.Dst)
+			assert.Equal(t, "80", flow.DstPort)
+		}
+	}
+}
+
+func Test_badFilterRecorder(t *testing.T) {
+	opened := 0
+	task := NewTask(Options{InterfaceName: "eth0", Filter: "port 80 and"})
+	task.WithRecorder(func() (OutputRecorder, error) {
+		opened++
+		return nil, errors.New("unexpected")
+	})
+
+	err := task.RunContext(context.Background())
+	assert.ErrorIs(t, err, ErrBadFilter)
+	assert.Equal(t, 0, opened, "the rejected run opens no recorder")
+}
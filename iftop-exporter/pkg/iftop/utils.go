@@ -1,6 +1,8 @@
 package iftop
 
 import (
+	"net"
+	"net/netip"
 	"regexp"
 	"strings"
 )
@@ -69,3 +71,29 @@ func extractIP(addr string) string {
 	// IPv4
 	return addr
 }
+
+// splitHostPort splits the address printed by iftop -P into the host and the port (or the service),
+// e.g. "10.0.10.204:http", "[fe80::1]:443", the port is empty if the address has none (e.g. ICMP).
+//
+// iftop appends the port to an IPv6 address without brackets, so the address is split at the last colon
+// only if the rest is still an IPv6 address.
+func splitHostPort(addr string) (host string, port string) {
+	if strings.HasPrefix(addr, "[") {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			return host, port
+		}
+		return addr, ""
+	}
+
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return addr, ""
+	}
+	host, port = addr[:i], addr[i+1:]
+	if strings.Contains(host, ":") {
+		if _, err := netip.ParseAddr(host); err != nil {
+			return addr, ""
+		}
+	}
+	return host, port
+}
@@ -34,3 +34,25 @@ func TestExtractIP(t *testing.T) {
 		assert.Equal(t, tt.expect, actual)
 	}
 }
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		port string
+	}{
+		{"10.0.10.201:36674", "10.0.10.201", "36674"},
+		{"10.0.10.204:http", "10.0.10.204", "http"},
+		{"10.0.10.204", "10.0.10.204", ""},
+		{"[fe80::1]:443", "fe80::1", "443"},
+		{"2001:db8::1:443", "2001:db8::1", "443"},
+		{"fe80::1", "fe80::1", ""},
+		{"node-1.example.com:ssh", "node-1.example.com", "ssh"},
+	}
+
+	for _, tt := range tests {
+		host, port := splitHostPort(tt.addr)
+		assert.Equal(t, tt.host, host, tt.addr)
+		assert.Equal(t, tt.port, port, tt.addr)
+	}
+}
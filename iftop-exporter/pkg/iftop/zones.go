@@ -0,0 +1,134 @@
+package iftop
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ZoneUnknown is the zone of the flow ends which are not IP addresses, e.g. the resolved hostnames.
+const ZoneUnknown = "unknown"
+
+// DefaultZone is the default zone of the addresses which match no CIDR.
+const DefaultZone = "public"
+
+var zoneNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// BuiltinZones are the zones of the special purpose ranges, see ParseZones for the format.
+const BuiltinZones = "loopback=127.0.0.0/8,::1/128;" +
+	"link_local=169.254.0.0/16,fe80::/10;" +
+	"private=10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7;" +
+	"cgnat=100.64.0.0/10"
+
+// DefaultZones are the BuiltinZones, the other addresses are in DefaultZone.
+var DefaultZones = MustParseZones(BuiltinZones, DefaultZone)
+
+// Zones assigns each flow end a zone by its address, e.g. pod-cidr, service-cidr, datacenter.
+// The most specific CIDR wins, so a zone may be carved out of a wider one.
+type Zones struct {
+	// prefixes are sorted from the longest to the shortest.
+	prefixes    []zonePrefix
+	defaultZone string
+}
+
+type zonePrefix struct {
+	prefix netip.Prefix
+	zone   string
+}
+
+// ParseZones parses the semicolon separated zones, each zone is `name=cidr[,cidr...]`,
+// e.g. "pod-cidr=10.244.0.0/16;service-cidr=10.96.0.0/12;datacenter=10.0.0.0/8,fd00::/8".
+// The addresses which match no CIDR are in defaultZone.
+func ParseZones(s string, defaultZone string) (*Zones, error) {
+	if !zoneNameRegexp.MatchString(defaultZone) {
+		return nil, fmt.Errorf("invalid default zone (%s), must match (%s)", defaultZone, zoneNameRegexp)
+	}
+
+	zones := &Zones{defaultZone: defaultZone}
+	seen := map[netip.Prefix]string{}
+
+	for _, item := range strings.Split(s, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, cidrs, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || strings.TrimSpace(cidrs) == "" {
+			return nil, fmt.Errorf("invalid zone (%s), must be name=cidr[,cidr...]", item)
+		}
+		if !zoneNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid zone name (%s), must match (%s)", name, zoneNameRegexp)
+		}
+
+		for _, cidr := range strings.Split(cidrs, ",") {
+			cidr = strings.TrimSpace(cidr)
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr (%s) of zone (%s), err: %s", cidr, name, err)
+			}
+			prefix = prefix.Masked()
+
+			if zone, ok := seen[prefix]; ok {
+				return nil, fmt.Errorf("cidr (%s) of zone (%s) is already in zone (%s)", cidr, name, zone)
+			}
+			seen[prefix] = name
+			zones.prefixes = append(zones.prefixes, zonePrefix{prefix: prefix, zone: name})
+		}
+	}
+
+	sort.SliceStable(zones.prefixes, func(i, j int) bool {
+		return zones.prefixes[i].prefix.Bits() > zones.prefixes[j].prefix.Bits()
+	})
+
+	return zones, nil
+}
+
+// MustParseZones is like ParseZones but panics if the zones are invalid.
+func MustParseZones(s string, defaultZone string) *Zones {
+	zones, err := ParseZones(s, defaultZone)
+	if err != nil {
+		panic(err)
+	}
+	return zones
+}
+
+// Lookup returns the zone of the flow end, the addr may contain port.
+// The nil Zones is DefaultZones.
+func (z *Zones) Lookup(addr string) string {
+	if z == nil {
+		z = DefaultZones
+	}
+
+	ip, err := netip.ParseAddr(extractIP(addr))
+	if err != nil {
+		return ZoneUnknown
+	}
+	// the IPv4-mapped IPv6 addresses match the IPv4 CIDRs
+	ip = ip.WithZone("").Unmap()
+
+	for _, p := range z.prefixes {
+		if p.prefix.Contains(ip) {
+			return p.zone
+		}
+	}
+	return z.defaultZone
+}
+
+// ClassifyFlow sets the zones of both ends of the flow.
+func (z *Zones) ClassifyFlow(flow *Flow) {
+	flow.SrcZone = z.Lookup(flow.Src)
+	flow.DstZone = z.Lookup(flow.Dst)
+}
+
+// DefaultZone returns the zone of the addresses which match no CIDR.
+// The nil Zones is DefaultZones.
+func (z *Zones) DefaultZone() string {
+	if z == nil {
+		z = DefaultZones
+	}
+	return z.defaultZone
+}
@@ -0,0 +1,79 @@
+package iftop
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseZones(t *testing.T) {
+	zones, err := ParseZones("datacenter=10.0.0.0/8, fd00::/8; pod-cidr=10.244.0.0/16;service-cidr=10.96.0.0/12", "internet")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		addr   string
+		expect string
+	}{
+		{"10.1.2.3", "datacenter"},
+		// the most specific cidr wins
+		{"10.244.1.2:8080", "pod-cidr"},
+		{"10.96.0.1", "service-cidr"},
+		{"[fd00::1]:443", "datacenter"},
+		{"::ffff:10.244.0.1", "pod-cidr"},
+		{"8.8.8.8", "internet"},
+		{"example.com", ZoneUnknown},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, zones.Lookup(tt.addr), tt.addr)
+	}
+
+	_, err = ParseZones("datacenter", "internet")
+	assert.Error(t, err)
+	_, err = ParseZones("datacenter=10.0.0.0/33", "internet")
+	assert.Error(t, err)
+	_, err = ParseZones("a=10.0.0.0/8;b=10.1.0.0/8", "internet")
+	assert.ErrorContains(t, err, "already in zone (a)")
+	_, err = ParseZones("my zone=10.0.0.0/8", "internet")
+	assert.Error(t, err)
+	_, err = ParseZones("", "")
+	assert.Error(t, err)
+}
+
+func TestDefaultZones(t *testing.T) {
+	var zones *Zones
+
+	tests := []struct {
+		addr   string
+		expect string
+	}{
+		{"127.0.0.1", "loopback"},
+		{"::1", "loopback"},
+		{"169.254.169.254:80", "link_local"},
+		{"fe80::1%eth0", "link_local"},
+		{"192.168.1.1", "private"},
+		{"fd12:3456::1", "private"},
+		{"100.64.0.1", "cgnat"},
+		{"1.1.1.1", DefaultZone},
+		{"2001:db8::1", DefaultZone},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expect, zones.Lookup(tt.addr), tt.addr)
+	}
+}
+
+func TestSumFlows(t *testing.T) {
+	flows := []*Flow{
+		{Src: "10.0.0.1", Dst: "10.0.0.2", Direction: FlowDirectionOut, SrcZone: "private", DstZone: "private", CumulativeBytes: 10},
+		{Src: "10.0.0.1", Dst: "10.0.0.3", Direction: FlowDirectionOut, SrcZone: "private", DstZone: "private", CumulativeBytes: 20},
+		{Src: "10.0.0.1", Dst: "1.1.1.1", Direction: FlowDirectionOut, SrcZone: "private", DstZone: "public", CumulativeBytes: 30},
+		{Src: "10.0.0.1", Dst: "1.1.1.1", Direction: FlowDirectionIn, SrcZone: "private", DstZone: "public", CumulativeBytes: 40},
+		{Src: "all", Dst: "all", Direction: FlowDirectionIn, SrcZone: "private", DstZone: "public", CumulativeBytes: 100},
+	}
+
+	sumFlows := SumFlows(flows)
+	assert.Equal(t, []*Flow{
+		{Src: "all", Dst: "all", Direction: FlowDirectionIn, SrcZone: "private", DstZone: "public", CumulativeBytes: 40},
+		{Src: "all", Dst: "all", Direction: FlowDirectionOut, SrcZone: "private", DstZone: "private", CumulativeBytes: 30},
+		{Src: "all", Dst: "all", Direction: FlowDirectionOut, SrcZone: "private", DstZone: "public", CumulativeBytes: 30},
+	}, sumFlows)
+}
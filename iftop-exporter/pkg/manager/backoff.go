@@ -0,0 +1,106 @@
+package manager
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// The states of a task, see iftop_exporter_task_state.
+const (
+	// TaskStateRunning means the task is running, or sleeping the interval between the periodic runs.
+	TaskStateRunning = "running"
+	// TaskStateWaiting means the task is waiting for a capture slot, see WithMaxConcurrentCaptures.
+	TaskStateWaiting = "waiting"
+	// TaskStateBackingOff means the latest run failed, the task is waiting to restart.
+	TaskStateBackingOff = "backing_off"
+	// TaskStateParked means the task failed too many times in a row, it is not restarted
+	// until its dynamic file changes or its link reappears.
+	TaskStateParked = "parked"
+)
+
+var taskStates = []string{TaskStateRunning, TaskStateWaiting, TaskStateBackingOff, TaskStateParked}
+
+const (
+	// DefaultBackoffMax is the default cap of the delay before restarting a failed task.
+	DefaultBackoffMax = 5 * time.Minute
+	// DefaultParkAfter is the default number of the consecutive failures to park a task.
+	DefaultParkAfter = 10
+)
+
+// WithBackoff sets the cap of the delay before restarting a failed task, and the number of the consecutive
+// failures to park a task, parkAfter 0 means the tasks are never parked.
+func (mgr *Manager) WithBackoff(backoffMax time.Duration, parkAfter int) *Manager {
+	mgr.backoffMax = backoffMax
+	mgr.parkAfter = parkAfter
+	return mgr
+}
+
+// backoff returns the delay before restarting a task after its consecutive failures.
+// The delay doubles from max(interval, 1s) up to backoffMax, half of it is randomized,
+// so the tasks which failed together do not restart in lockstep.
+// A backoffMax below max(interval, 1s) does not restart a failed task sooner than a successful one.
+func (mgr *Manager) backoff(failures int) time.Duration {
+	base := max(mgr.interval, time.Second)
+	delay := base
+	for i := 1; i < failures && delay < mgr.backoffMax; i++ {
+		delay *= 2
+	}
+	if mgr.backoffMax > 0 {
+		delay = min(delay, max(mgr.backoffMax, base))
+	}
+
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
+
+// setTaskState records the state of the task of the interface.
+func (mgr *Manager) setTaskState(interfaceName string, state string) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	// the state of a removed interface is not recorded again by a late run
+	if _, ok := mgr.removeChs[interfaceName]; !ok {
+		return
+	}
+	mgr.taskStates[interfaceName] = state
+
+	for _, s := range taskStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		taskState.WithLabelValues(interfaceName, s).Set(value)
+	}
+}
+
+// park blocks until the task of the interface is resumed, removed or the Manager shuts down,
+// it reports whether the task is resumed.
+func (mgr *Manager) park(interfaceName string, removeCh <-chan int) bool {
+	resumeCh := make(chan struct{})
+	mgr.lock.Lock()
+	mgr.resumeChs[interfaceName] = resumeCh
+	mgr.lock.Unlock()
+	mgr.setTaskState(interfaceName, TaskStateParked)
+
+	select {
+	case <-resumeCh:
+		log.Printf("parked iftop task (%s) resumed", interfaceName)
+		return true
+	case <-removeCh:
+		return false
+	case <-mgr.done:
+		return false
+	}
+}
+
+// resume restarts the task of the interface if it is parked.
+func (mgr *Manager) resume(interfaceName string) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	if resumeCh, ok := mgr.resumeChs[interfaceName]; ok {
+		close(resumeCh)
+		delete(mgr.resumeChs, interfaceName)
+	}
+}
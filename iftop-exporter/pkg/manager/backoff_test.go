@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(false, 10*time.Second, 3*time.Second)
+	mgr.WithBackoff(time.Minute, 0)
+
+	tests := []struct {
+		failures int
+		delay    time.Duration // before jitter
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{100, time.Minute},
+	}
+
+	for _, tt := range tests {
+		for range 20 {
+			delay := mgr.backoff(tt.failures)
+			assert.GreaterOrEqual(t, delay, tt.delay/2, "failures %d", tt.failures)
+			assert.LessOrEqual(t, delay, tt.delay, "failures %d", tt.failures)
+		}
+	}
+
+	// the continuous mode backs off from one second
+	mgr.WithContinuous(true, 0, 0)
+	assert.LessOrEqual(t, mgr.backoff(1), time.Second)
+	assert.GreaterOrEqual(t, mgr.backoff(1), 500*time.Millisecond)
+
+	// the cap below the interval does not shorten the delay under the interval
+	mgr.WithContinuous(false, 10*time.Second, 3*time.Second)
+	mgr.WithBackoff(time.Second, 0)
+	for _, failures := range []int{1, 2, 100} {
+		delay := mgr.backoff(failures)
+		assert.GreaterOrEqual(t, delay, 5*time.Second, "failures %d", failures)
+		assert.LessOrEqual(t, delay, 10*time.Second, "failures %d", failures)
+	}
+}
+
+func TestManagerPark(t *testing.T) {
+	factory := &fakeFactory{runFor: time.Millisecond, err: errors.New("no such device")}
+
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 0, 0)
+	// the backoff is max(interval, 1s) halved by the jitter at least, so the tasks are parked after a few seconds
+	mgr.WithBackoff(time.Second, 3)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	done := make(chan struct{})
+	go func() {
+		mgr.exec("park0")
+		close(done)
+	}()
+
+	taskStateOf := func() string {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		return mgr.taskStates["park0"]
+	}
+
+	assert.Eventually(t, func() bool {
+		return taskStateOf() == TaskStateParked
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, factory.created(), "no run is started after parked")
+	assert.Equal(t, 1.0, testutil.ToFloat64(taskState.WithLabelValues("park0", TaskStateParked)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(taskState.WithLabelValues("park0", TaskStateRunning)))
+	assert.Equal(t, TaskStateParked, mgr.Health().Tasks.Interfaces[0].State)
+
+	// the resumed task runs at once, and gets the full failure budget again
+	factory.lock.Lock()
+	factory.err = nil
+	factory.runFor = time.Hour
+	factory.lock.Unlock()
+	mgr.resume("park0")
+	assert.Eventually(t, func() bool {
+		return taskStateOf() == TaskStateRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 4, factory.created())
+
+	mgr.stop("park0")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exec did not return after stop")
+	}
+	assert.Empty(t, mgr.taskStates)
+}
+
+func TestManagerParkBadFilter(t *testing.T) {
+	factory := &fakeFactory{runFor: time.Millisecond, err: &iftop.RunError{Kind: iftop.ErrBadFilter, Message: "syntax error"}}
+
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 0, 0)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	done := make(chan struct{})
+	go func() {
+		mgr.exec("badfilter0")
+		close(done)
+	}()
+
+	// a bad filter is parked at the first failure, instead of backing off DefaultParkAfter times
+	assert.Eventually(t, func() bool {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		return mgr.taskStates["badfilter0"] == TaskStateParked
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, factory.created())
+
+	mgr.stop("badfilter0")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exec did not return after stop")
+	}
+}
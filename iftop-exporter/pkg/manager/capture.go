@@ -0,0 +1,213 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+)
+
+// InterfaceFileVersion is the latest version of the dynamic interface file,
+// the files without version are regarded as version 1.
+const InterfaceFileVersion = 1
+
+// The keys of the dynamic interface file which are not the interface info.
+const (
+	interfaceFileVersionKey = "version"
+	interfaceFileCaptureKey = "capture"
+)
+
+// minDuration is the min duration of each iftop run, iftop needs a few seconds to print the first output.
+const minDuration = 3 * time.Second
+
+// CaptureOptions overrides the global capture options for an interface, it is carried in the "capture"
+// object of the dynamic interface file. The zero values keep the global options.
+type CaptureOptions struct {
+	// SortBy is the window iftop sorts the flows by, which decides the flows printed within NumberOfLines.
+	SortBy iftop.SortBy `json:"sort_by,omitempty"`
+	// ShowPort shows the ports as well as the hosts.
+	ShowPort *bool `json:"show_port,omitempty"`
+	// NoPortConvert does not convert the port numbers to the services.
+	NoPortConvert *bool `json:"no_port_convert,omitempty"`
+	// NumberOfLines is the number of the flows iftop prints.
+	NumberOfLines int `json:"number_of_lines,omitempty"`
+	// Duration is the duration of each run in periodic mode, e.g. "10s", it is ignored in continuous mode.
+	Duration string `json:"duration,omitempty"`
+	// Filter is the pcap filter code, e.g. "not port 8080", "tcp".
+	Filter string `json:"filter,omitempty"`
+	// NetFilter is the IPv4 network which iftop takes as local to determine the direction of the flows, e.g. "10.0.0.0/8".
+	NetFilter string `json:"net_filter,omitempty"`
+	// NetFilter6 is the IPv6 network which iftop takes as local, e.g. "fd00::/8".
+	NetFilter6 string `json:"net_filter6,omitempty"`
+	// Promiscuous captures the traffic not for this host, e.g. on a mirror port.
+	Promiscuous *bool `json:"promiscuous,omitempty"`
+}
+
+// interfaceFile is the dynamic interface file, besides the interface info.
+type interfaceFile struct {
+	Version int             `json:"version"`
+	Capture json.RawMessage `json:"capture"`
+}
+
+// parseInterfaceFile parses the version and the capture options of the dynamic interface file,
+// the capture options are nil if the file carries none.
+func parseInterfaceFile(b []byte) (*CaptureOptions, error) {
+	file := interfaceFile{}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+
+	if file.Version < 0 || file.Version > InterfaceFileVersion {
+		return nil, fmt.Errorf("unsupported version (%d), the latest supported version is (%d)", file.Version, InterfaceFileVersion)
+	}
+
+	if len(file.Capture) == 0 || string(file.Capture) == "null" {
+		return nil, nil
+	}
+
+	capture := &CaptureOptions{}
+	decoder := json.NewDecoder(bytes.NewReader(file.Capture))
+	// a misspelled option should not be silently ignored
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(capture); err != nil {
+		return nil, fmt.Errorf("invalid capture options, err: %s", err)
+	}
+
+	return capture, nil
+}
+
+// Valid checks the capture options against the run pattern of the Manager.
+func (c *CaptureOptions) Valid(continuous bool, interval time.Duration) error {
+	switch c.SortBy {
+	case "", iftop.SortBy2s, iftop.SortBy10s, iftop.SortBy40s, iftop.SortBySource, iftop.SortByDestination:
+	default:
+		return fmt.Errorf("invalid sort by (%s), valid values are: %s, %s, %s, %s, %s", c.SortBy,
+			iftop.SortBy2s, iftop.SortBy10s, iftop.SortBy40s, iftop.SortBySource, iftop.SortByDestination)
+	}
+
+	if err := iftop.ValidFilter(c.Filter); err != nil {
+		return err
+	}
+	if err := iftop.ValidNetFilter(c.NetFilter, false); err != nil {
+		return err
+	}
+	if err := iftop.ValidNetFilter(c.NetFilter6, true); err != nil {
+		return err
+	}
+
+	if c.NumberOfLines < 0 {
+		return fmt.Errorf("invalid number of lines (%d), must not be negative", c.NumberOfLines)
+	}
+
+	if c.Duration != "" {
+		duration, err := c.duration()
+		if err != nil {
+			return fmt.Errorf("invalid duration (%s), err: %s", c.Duration, err)
+		}
+		if duration < minDuration {
+			return fmt.Errorf("invalid duration (%s), must not be less than (%s)", c.Duration, minDuration)
+		}
+		if !continuous && duration >= interval {
+			return fmt.Errorf("invalid duration (%s), must be less than interval (%s)", c.Duration, interval)
+		}
+	}
+
+	return nil
+}
+
+func (c *CaptureOptions) duration() (time.Duration, error) {
+	return time.ParseDuration(c.Duration)
+}
+
+// apply overrides the options with the capture options.
+func (c *CaptureOptions) apply(options *iftop.Options, continuous bool) {
+	if c.SortBy != "" {
+		options.SortBy = c.SortBy
+	}
+	if c.ShowPort != nil {
+		options.ShowPort = *c.ShowPort
+	}
+	if c.NoPortConvert != nil {
+		options.NoPortConvert = *c.NoPortConvert
+	}
+	if c.NumberOfLines > 0 {
+		options.NumberOfLines = c.NumberOfLines
+	}
+	if c.Filter != "" {
+		options.Filter = c.Filter
+	}
+	if c.NetFilter != "" {
+		options.NetFilter = c.NetFilter
+	}
+	if c.NetFilter6 != "" {
+		options.NetFilter6 = c.NetFilter6
+	}
+	if c.Promiscuous != nil {
+		options.Promiscuous = *c.Promiscuous
+	}
+	if c.Duration != "" && !continuous {
+		if duration, err := c.duration(); err == nil {
+			options.SingleSeconds = int(duration.Seconds())
+		}
+	}
+}
+
+// WithCaptureOptions sets the capture options of all interfaces, which are overridden by the capture options
+// of the dynamic interface files, nil means the defaults.
+func (mgr *Manager) WithCaptureOptions(capture *CaptureOptions) error {
+	if capture != nil {
+		if err := capture.Valid(mgr.continuous, mgr.interval); err != nil {
+			return err
+		}
+	}
+	mgr.captureDefaults = capture
+	return nil
+}
+
+// setCaptureOptions records the capture options of the interface, nil means the global options.
+// In continuous mode, the run in progress is restarted to apply the changed options,
+// in periodic mode, they are applied from the next run.
+func (mgr *Manager) setCaptureOptions(interfaceName string, capture *CaptureOptions) {
+	mgr.lock.Lock()
+	old := mgr.captureOverrides[interfaceName]
+	if capture == nil {
+		delete(mgr.captureOverrides, interfaceName)
+	} else {
+		mgr.captureOverrides[interfaceName] = capture
+	}
+	source, running := mgr.running[interfaceName]
+	restart := running && mgr.continuous && !equalCaptureOptions(old, capture)
+	if restart {
+		mgr.restarting[interfaceName] = true
+	}
+	mgr.lock.Unlock()
+
+	if restart {
+		log.Printf("capture options of interface (%s) changed, restart iftop task", interfaceName)
+		if err := source.Stop(); err != nil {
+			log.Printf("stop iftop task (%s) failed, err: %s", interfaceName, err)
+		}
+	}
+}
+
+// takeRestart reports whether the run of the interface was stopped to apply the changed options, and clears it.
+func (mgr *Manager) takeRestart(interfaceName string) bool {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	restarting := mgr.restarting[interfaceName]
+	delete(mgr.restarting, interfaceName)
+	return restarting
+}
+
+func equalCaptureOptions(a *CaptureOptions, b *CaptureOptions) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
@@ -0,0 +1,181 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInterfaceFile(t *testing.T) {
+	capture, err := parseInterfaceFile([]byte(`{"owner": "default/pod0"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, capture, "the files without version and capture are still valid")
+
+	capture, err = parseInterfaceFile([]byte(`{
+		"version": 1,
+		"owner": "default/pod0",
+		"capture": {"sort_by": "10s", "show_port": true, "number_of_lines": 20, "duration": "5s"}
+	}`))
+	assert.NoError(t, err)
+	showPort := true
+	assert.Equal(t, &CaptureOptions{SortBy: iftop.SortBy10s, ShowPort: &showPort, NumberOfLines: 20, Duration: "5s"}, capture)
+
+	_, err = parseInterfaceFile([]byte(`{"version": 2}`))
+	assert.ErrorContains(t, err, "unsupported version")
+
+	_, err = parseInterfaceFile([]byte(`{"capture": {"sortby": "10s"}}`))
+	assert.ErrorContains(t, err, "unknown field", "the misspelled options are rejected")
+
+	// the version and the capture options are not the interface info
+	info, err := parseInterfaceInfo([]byte(`{"version": 1, "owner": "default/pod0", "capture": {"sort_by": "10s"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "default/pod0"}, info)
+}
+
+func TestCaptureOptionsValid(t *testing.T) {
+	interval := 10 * time.Second
+
+	assert.NoError(t, (&CaptureOptions{}).Valid(false, interval))
+	assert.NoError(t, (&CaptureOptions{SortBy: iftop.SortBySource, Duration: "5s"}).Valid(false, interval))
+	assert.NoError(t, (&CaptureOptions{Duration: "1m"}).Valid(true, interval), "the duration is ignored in continuous mode")
+
+	assert.Error(t, (&CaptureOptions{SortBy: "1m"}).Valid(false, interval))
+	assert.Error(t, (&CaptureOptions{NumberOfLines: -1}).Valid(false, interval))
+	assert.Error(t, (&CaptureOptions{Duration: "five"}).Valid(false, interval))
+	assert.Error(t, (&CaptureOptions{Duration: "1s"}).Valid(false, interval))
+	assert.Error(t, (&CaptureOptions{Duration: "10s"}).Valid(false, interval), "the duration must be less than interval")
+}
+
+func TestManagerCaptureOptions(t *testing.T) {
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(false, 10*time.Second, 3*time.Second)
+
+	options := mgr.captureOptions("eth0")
+	assert.Equal(t, iftop.SortBy2s, options.SortBy)
+	assert.Equal(t, 3, options.SingleSeconds)
+	assert.Equal(t, 13*time.Second, mgr.hangTimeout(options))
+
+	showPort := true
+	mgr.setCaptureOptions("eth0", &CaptureOptions{SortBy: iftop.SortBy40s, ShowPort: &showPort, Duration: "8s"})
+	options = mgr.captureOptions("eth0")
+	assert.Equal(t, iftop.SortBy40s, options.SortBy)
+	assert.True(t, options.ShowPort)
+	assert.Equal(t, 8, options.SingleSeconds)
+	assert.Equal(t, 18*time.Second, mgr.hangTimeout(options))
+	assert.Equal(t, 3, mgr.captureOptions("eth1").SingleSeconds, "the other interfaces keep the global options")
+
+	mgr.setCaptureOptions("eth0", nil)
+	assert.Equal(t, iftop.SortBy2s, mgr.captureOptions("eth0").SortBy)
+}
+
+// TestManagerExecIftopTask starts a task with the iftop backend, whose factory reads the capture options under the lock.
+func TestManagerExecIftopTask(t *testing.T) {
+	mgr, err := NewManager(nil, true, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 100*time.Millisecond, 0)
+	mgr.setCaptureOptions("veth0", &CaptureOptions{SortBy: iftop.SortBy10s})
+
+	done := make(chan struct{})
+	go func() {
+		mgr.exec("veth0")
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(mgr.sources()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mgr.stop("veth0")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exec did not return after stop")
+	}
+}
+
+func TestManagerRestartOnCaptureOptionsChange(t *testing.T) {
+	if exists, err := linkExists(existingLink); err != nil || !exists {
+		t.Skipf("link (%s) is not available, err: %v", existingLink, err)
+	}
+
+	factory := &fakeFactory{runFor: time.Hour}
+	dynamicDir := t.TempDir()
+	fileName := filepath.Join(dynamicDir, existingLink)
+
+	mgr, err := NewManager(nil, true, dynamicDir)
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 0, 0)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	running := func() FlowSource {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		return mgr.running[existingLink]
+	}
+
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"version": 1, "capture": {"sort_by": "10s"}}`), 0o644))
+	assert.NoError(t, mgr.addDynamic(existingLink, fileName))
+	assert.Eventually(t, func() bool {
+		return running() != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	first := running()
+
+	// the same options do not restart the run
+	assert.NoError(t, mgr.addDynamic(existingLink, fileName))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, factory.created())
+
+	// an invalid file is ignored, the run keeps its options
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"version": 1, "capture": {"sort_by": "1h"}}`), 0o644))
+	assert.Error(t, mgr.addDynamic(existingLink, fileName))
+	assert.Equal(t, iftop.SortBy10s, mgr.captureOptions(existingLink).SortBy)
+
+	// the changed options restart the run at once
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"version": 1, "capture": {"sort_by": "40s"}}`), 0o644))
+	assert.NoError(t, mgr.addDynamic(existingLink, fileName))
+	assert.Eventually(t, func() bool {
+		source := running()
+		return source != nil && source != first
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, factory.created())
+	assert.Equal(t, iftop.SortBy40s, mgr.captureOptions(existingLink).SortBy)
+
+	mgr.lock.Lock()
+	assert.Empty(t, mgr.restarting)
+	assert.Equal(t, TaskStateRunning, mgr.taskStates[existingLink], "the restart is not a failure")
+	mgr.lock.Unlock()
+
+	mgr.stop(existingLink)
+}
+
+func TestCaptureOptionsFilters(t *testing.T) {
+	capture, err := parseInterfaceFile([]byte(`{"capture": {"filter": "not port 10250", "net_filter": "10.244.0.0/16", "promiscuous": true}}`))
+	assert.NoError(t, err)
+	assert.NoError(t, capture.Valid(true, 0))
+
+	assert.ErrorIs(t, (&CaptureOptions{Filter: "port 80 and"}).Valid(true, 0), iftop.ErrBadFilter)
+	assert.Error(t, (&CaptureOptions{NetFilter: "fd00::/8"}).Valid(true, 0))
+	assert.Error(t, (&CaptureOptions{NetFilter6: "10.0.0.0/8"}).Valid(true, 0))
+
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	assert.Error(t, mgr.WithCaptureOptions(&CaptureOptions{Filter: "(tcp"}))
+	assert.NoError(t, mgr.WithCaptureOptions(&CaptureOptions{Filter: "tcp", NetFilter: "10.0.0.0/8"}))
+
+	// the capture options of the interface file override the global ones
+	mgr.setCaptureOptions("eth0", capture)
+	options := mgr.captureOptions("eth0")
+	assert.Equal(t, "not port 10250", options.Filter)
+	assert.Equal(t, "10.244.0.0/16", options.NetFilter)
+	assert.True(t, options.Promiscuous)
+
+	options = mgr.captureOptions("eth1")
+	assert.Equal(t, "tcp", options.Filter)
+	assert.Equal(t, "10.0.0.0/8", options.NetFilter)
+	assert.False(t, options.Promiscuous)
+}
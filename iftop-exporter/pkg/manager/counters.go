@@ -0,0 +1,328 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+)
+
+// flowForgetAfter is how long an unseen flow is remembered in a run.
+// iftop forgets a flow after 40 seconds without traffic and restarts its cumulative bytes from zero,
+// so a flow unseen for longer than that is treated as a new flow when it shows up again.
+const flowForgetAfter = 60 * time.Second
+
+// flowTotalForgetAfter is how long the per flow counter of a flow without traffic is kept.
+const flowTotalForgetAfter = time.Hour
+
+// byteCounters turns the cumulative bytes reported by each round into deltas,
+// which are accumulated into monotonic counters that survive iftop restarts.
+//
+// The cumulative bytes of iftop count from the start of each run, so:
+//   - the first observed round of a run contributes all its cumulative bytes,
+//   - the following rounds of the same run contribute the growth since the last observed round,
+//   - a round observed twice contributes nothing.
+//
+// The traffic in the gaps between runs (non-continuous mode) is never observed, so it is not counted.
+// Instead, the sampling coverage of each run is measured, and the estimated bytes scale the bytes
+// of the first round of each run (which stands for the gap before it) by the coverage.
+type byteCounters struct {
+	lock   sync.Mutex
+	runs   map[string]*observedRun     // key is interfaceName
+	totals map[string]*interfaceTotals // key is interfaceName
+
+	// defaultCoverage is the expected sampling coverage, used before any gap could be measured.
+	defaultCoverage float64
+	// flowCounters enables the per flow totals, the per zone pair ("all" flows) totals are always kept.
+	flowCounters bool
+	// maxFlowTotals is the max number of the per flow totals of each interface, 0 means unlimited,
+	// the bytes of the flows out of the limit are added to the src="other",dst="other" totals.
+	maxFlowTotals int
+	// portLabels maps the ports of the flows to the port labels of the per flow totals.
+	portLabels PortLabels
+	// peers resolves the dst of the flows to the peer labels of the per flow totals, nil means disabled.
+	peers *peerIndex
+}
+
+// interfaceTotals holds the values of the monotonic counters of an interface.
+type interfaceTotals struct {
+	sent          float64
+	recv          float64
+	estimatedSent float64
+	estimatedRecv float64
+	flows         map[flowTotalKey]*flowTotal
+}
+
+type flowTotalKey struct {
+	src       string
+	dst       string
+	direction iftop.FlowDirection
+	srcZone   string
+	dstZone   string
+	srcPort   string
+	dstPort   string
+}
+
+type flowTotal struct {
+	bytes      float64
+	lastUpdate time.Time
+	// peerOwner and peerKind are resolved once when the total is created,
+	// so a later change of the peer index does not split the series of the flow.
+	peerOwner string
+	peerKind  string
+}
+
+type observedRun struct {
+	runStart time.Time
+	round    uint64
+	sent     float64
+	recv     float64
+	flows    map[flowCounterKey]*observedFlow
+
+	// wallStart is the end of the last round observed in the previous run, zero for the first observed run.
+	wallStart    time.Time
+	lastRoundEnd time.Time
+	// coverage is the ratio of the time the run observed to the wall time since wallStart.
+	coverage float64
+}
+
+type flowCounterKey struct {
+	src       string
+	dst       string
+	srcPort   string
+	dstPort   string
+	direction iftop.FlowDirection
+}
+
+type observedFlow struct {
+	cumulative float64
+	lastSeen   time.Time
+}
+
+// roundDelta holds the bytes a round adds to the counters.
+type roundDelta struct {
+	sent  float64
+	recv  float64
+	flows []flowDelta
+
+	// estimateFactor scales the observed bytes of the round to the estimated bytes.
+	estimateFactor float64
+	// coverage is the sampling coverage ratio of the run.
+	coverage float64
+}
+
+type flowDelta struct {
+	flow  *iftop.Flow
+	bytes float64
+}
+
+func newByteCounters() *byteCounters {
+	return &byteCounters{
+		runs:            make(map[string]*observedRun),
+		totals:          make(map[string]*interfaceTotals),
+		defaultCoverage: 1,
+		portLabels:      PortLabels{EphemeralMin: DefaultEphemeralPortMin},
+	}
+}
+
+// observe returns the delta of the round in state, ok is false if the round
+// has no flow stats or has already been observed.
+func (c *byteCounters) observe(interfaceName string, state iftop.State) (delta roundDelta, ok bool) {
+	if state.FlowStats == nil || state.Round == 0 {
+		return delta, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	firstRound := false
+	run, exists := c.runs[interfaceName]
+	if !exists || !run.runStart.Equal(state.RunStart) {
+		// a new run, its cumulative bytes count from zero
+		newRun := &observedRun{
+			runStart: state.RunStart,
+			flows:    make(map[flowCounterKey]*observedFlow),
+		}
+		if exists {
+			newRun.wallStart = run.lastRoundEnd
+		}
+		run = newRun
+		c.runs[interfaceName] = run
+		firstRound = true
+	} else if state.Round <= run.round {
+		return delta, false
+	}
+	run.round = state.Round
+	run.lastRoundEnd = state.RoundEnd
+
+	run.coverage = c.defaultCoverage
+	if wall := state.RoundEnd.Sub(run.wallStart); !run.wallStart.IsZero() && wall > 0 && state.RunDuration > 0 {
+		run.coverage = min(1, state.RunDuration.Seconds()/wall.Seconds())
+	}
+	delta.coverage = run.coverage
+
+	// The first round stands for the whole wall time since the previous run,
+	// the following rounds of the same run are contiguous, they need no scaling.
+	delta.estimateFactor = 1
+	if firstRound && run.coverage > 0 {
+		delta.estimateFactor = 1 / run.coverage
+	}
+
+	delta.sent = growth(run.sent, state.FlowStats.CumulativeSentBytes)
+	delta.recv = growth(run.recv, state.FlowStats.CumulativeRecvBytes)
+	run.sent = state.FlowStats.CumulativeSentBytes
+	run.recv = state.FlowStats.CumulativeRecvBytes
+
+	now := state.RoundEnd
+	for _, flow := range state.FlowStats.Flows {
+		if flow == nil || flow.Src == "" || flow.Dst == "" || flow.Src == "all" {
+			continue
+		}
+
+		key := flowCounterKey{src: flow.Src, dst: flow.Dst, srcPort: flow.SrcPort, dstPort: flow.DstPort, direction: flow.Direction}
+		last, seen := run.flows[key]
+		if !seen {
+			last = &observedFlow{}
+			run.flows[key] = last
+		}
+
+		delta.flows = append(delta.flows, flowDelta{
+			flow:  flow,
+			bytes: growth(last.cumulative, flow.CumulativeBytes),
+		})
+		last.cumulative = flow.CumulativeBytes
+		last.lastSeen = now
+	}
+
+	for key, flow := range run.flows {
+		if now.Sub(flow.lastSeen) > flowForgetAfter {
+			delete(run.flows, key)
+		}
+	}
+
+	c.addTotals(interfaceName, delta, now)
+
+	return delta, true
+}
+
+// addTotals adds the delta of a round to the counters of the interface.
+func (c *byteCounters) addTotals(interfaceName string, delta roundDelta, now time.Time) {
+	totals, ok := c.totals[interfaceName]
+	if !ok {
+		totals = &interfaceTotals{
+			flows: make(map[flowTotalKey]*flowTotal),
+		}
+		c.totals[interfaceName] = totals
+	}
+
+	totals.sent += delta.sent
+	totals.recv += delta.recv
+	totals.estimatedSent += delta.sent * delta.estimateFactor
+	totals.estimatedRecv += delta.recv * delta.estimateFactor
+
+	for _, d := range delta.flows {
+		// the "all" flows of a zone pair are kept once seen
+		sumKey := flowTotalKey{src: "all", dst: "all", direction: d.flow.Direction, srcZone: d.flow.SrcZone, dstZone: d.flow.DstZone}
+		sum, ok := totals.flows[sumKey]
+		if !ok {
+			sum = &flowTotal{}
+			totals.flows[sumKey] = sum
+		}
+		sum.bytes += d.bytes
+		sum.lastUpdate = now
+
+		if !c.flowCounters {
+			continue
+		}
+
+		key := flowTotalKey{
+			src:       d.flow.Src,
+			dst:       d.flow.Dst,
+			direction: d.flow.Direction,
+			srcZone:   d.flow.SrcZone,
+			dstZone:   d.flow.DstZone,
+			srcPort:   c.portLabels.label(d.flow.SrcPort),
+			dstPort:   c.portLabels.label(d.flow.DstPort),
+		}
+		total, ok := totals.flows[key]
+		if !ok && c.maxFlowTotals > 0 && totals.numFlows() >= c.maxFlowTotals {
+			key = flowTotalKey{src: otherFlow, dst: otherFlow, direction: d.flow.Direction, srcZone: d.flow.SrcZone, dstZone: d.flow.DstZone}
+			total, ok = totals.flows[key]
+		}
+		if !ok {
+			total = &flowTotal{}
+			if key.src != otherFlow {
+				total.peerOwner, total.peerKind = c.peers.labels(d.flow)
+			}
+			totals.flows[key] = total
+		}
+		total.bytes += d.bytes
+		total.lastUpdate = now
+	}
+
+	for key, total := range totals.flows {
+		if key.src != "all" && key.src != otherFlow && now.Sub(total.lastUpdate) > flowTotalForgetAfter {
+			delete(totals.flows, key)
+		}
+	}
+}
+
+// numFlows returns the number of the per flow totals, the "all" and "other" totals are not counted.
+func (totals *interfaceTotals) numFlows() int {
+	n := 0
+	for key := range totals.flows {
+		if key.src != "all" && key.src != otherFlow {
+			n++
+		}
+	}
+	return n
+}
+
+// totalsOf returns a copy of the counters of the interface.
+func (c *byteCounters) totalsOf(interfaceName string) (interfaceTotals, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	totals, ok := c.totals[interfaceName]
+	if !ok {
+		return interfaceTotals{}, false
+	}
+
+	result := *totals
+	result.flows = make(map[flowTotalKey]*flowTotal, len(totals.flows))
+	for key, total := range totals.flows {
+		t := *total
+		result.flows[key] = &t
+	}
+	return result, true
+}
+
+// coverage returns the sampling coverage ratio of the last observed run of the interface.
+func (c *byteCounters) coverage(interfaceName string) (float64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	run, ok := c.runs[interfaceName]
+	if !ok {
+		return 0, false
+	}
+	return run.coverage, true
+}
+
+// forget drops the observed run of the interface.
+func (c *byteCounters) forget(interfaceName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.runs, interfaceName)
+	delete(c.totals, interfaceName)
+}
+
+// growth returns how much the cumulative bytes grew since last.
+// A decreased value means the cumulative restarted from zero (e.g. iftop forgot and re-added the flow),
+// so all of it is growth. The result is never negative.
+func growth(last float64, current float64) float64 {
+	if current < last {
+		return current
+	}
+	return current - last
+}
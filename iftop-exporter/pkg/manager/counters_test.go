@@ -0,0 +1,165 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRoundState(runStart time.Time, round uint64, sent float64, flows ...*iftop.Flow) iftop.State {
+	return iftop.State{
+		Interface: "eth0",
+		FlowStats: &iftop.FlowStats{
+			Flows:               flows,
+			CumulativeSentBytes: sent,
+		},
+		Round:    round,
+		RunStart: runStart,
+		RoundEnd: runStart.Add(time.Duration(round) * 2 * time.Second),
+	}
+}
+
+func newOutFlow(dst string, cumulative float64) *iftop.Flow {
+	return &iftop.Flow{
+		Src:             "10.0.0.1",
+		Dst:             dst,
+		Direction:       iftop.FlowDirectionOut,
+		SrcZone:         "private",
+		DstZone:         "private",
+		CumulativeBytes: cumulative,
+	}
+}
+
+func TestByteCounters(t *testing.T) {
+	c := newByteCounters()
+	run1 := time.Now()
+
+	// the first round of a run contributes all its cumulative bytes
+	delta, ok := c.observe("eth0", newRoundState(run1, 1, 100, newOutFlow("10.0.0.2", 100)))
+	assert.True(t, ok)
+	assert.Equal(t, 100.0, delta.sent)
+	assert.Equal(t, 100.0, delta.flows[0].bytes)
+
+	// the same round observed again contributes nothing
+	_, ok = c.observe("eth0", newRoundState(run1, 1, 100, newOutFlow("10.0.0.2", 100)))
+	assert.False(t, ok)
+
+	// the next round contributes the growth, a new flow contributes all its bytes
+	delta, ok = c.observe("eth0", newRoundState(run1, 2, 250,
+		newOutFlow("10.0.0.2", 150),
+		newOutFlow("10.0.0.3", 100),
+	))
+	assert.True(t, ok)
+	assert.Equal(t, 150.0, delta.sent)
+	assert.Equal(t, 50.0, delta.flows[0].bytes)
+	assert.Equal(t, 100.0, delta.flows[1].bytes)
+
+	// a flow hidden in round 3 keeps its last cumulative bytes
+	_, ok = c.observe("eth0", newRoundState(run1, 3, 300, newOutFlow("10.0.0.3", 150)))
+	assert.True(t, ok)
+	delta, ok = c.observe("eth0", newRoundState(run1, 4, 400, newOutFlow("10.0.0.2", 200)))
+	assert.True(t, ok)
+	assert.Equal(t, 50.0, delta.flows[0].bytes)
+
+	// a new run restarts the cumulative bytes from zero, the counters keep growing
+	run2 := run1.Add(time.Minute)
+	delta, ok = c.observe("eth0", newRoundState(run2, 1, 30, newOutFlow("10.0.0.2", 30)))
+	assert.True(t, ok)
+	assert.Equal(t, 30.0, delta.sent)
+	assert.Equal(t, 30.0, delta.flows[0].bytes)
+
+	// rounds without flow stats are ignored
+	_, ok = c.observe("eth0", iftop.State{Interface: "eth0"})
+	assert.False(t, ok)
+}
+
+func TestByteCountersCoverage(t *testing.T) {
+	c := newByteCounters()
+	c.defaultCoverage = 0.4
+
+	// non-continuous mode, each run observes 4s, then sleeps 10s
+	newRun := func(runStart time.Time, sent float64) iftop.State {
+		return iftop.State{
+			FlowStats:   &iftop.FlowStats{CumulativeSentBytes: sent},
+			Round:       1,
+			RunStart:    runStart,
+			RoundEnd:    runStart.Add(4 * time.Second),
+			RunDuration: 4 * time.Second,
+		}
+	}
+
+	start := time.Now()
+
+	// the gap before the first run is unknown, the expected coverage is used
+	delta, ok := c.observe("eth0", newRun(start, 100))
+	assert.True(t, ok)
+	assert.Equal(t, 0.4, delta.coverage)
+	assert.InDelta(t, 2.5, delta.estimateFactor, 1e-9)
+
+	// 4s observed in the 14s since the end of the previous run
+	delta, ok = c.observe("eth0", newRun(start.Add(14*time.Second), 100))
+	assert.True(t, ok)
+	assert.InDelta(t, 4.0/14, delta.coverage, 1e-9)
+	assert.InDelta(t, 3.5, delta.estimateFactor, 1e-9)
+	assert.Equal(t, 100.0, delta.sent, "the observed bytes are not scaled")
+
+	coverage, ok := c.coverage("eth0")
+	assert.True(t, ok)
+	assert.InDelta(t, 4.0/14, coverage, 1e-9)
+
+	// the following rounds of a run are contiguous
+	next := newRun(start.Add(14*time.Second), 200)
+	next.Round = 2
+	next.RoundEnd = next.RoundEnd.Add(2 * time.Second)
+	next.RunDuration += 2 * time.Second
+	delta, ok = c.observe("eth0", next)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, delta.estimateFactor)
+	assert.InDelta(t, 6.0/16, delta.coverage, 1e-9)
+}
+
+func TestByteCountersMaxFlowTotals(t *testing.T) {
+	c := newByteCounters()
+	c.flowCounters = true
+	c.maxFlowTotals = 1
+	run := time.Now()
+
+	c.observe("eth0", newRoundState(run, 1, 300,
+		newOutFlow("10.0.0.2", 100),
+		newOutFlow("10.0.0.3", 200),
+	))
+
+	totals, ok := c.totalsOf("eth0")
+	assert.True(t, ok)
+	assert.Equal(t, 100.0, totals.flows[flowTotalKey{src: "10.0.0.1", dst: "10.0.0.2", direction: iftop.FlowDirectionOut, srcZone: "private", dstZone: "private"}].bytes)
+	assert.Equal(t, 200.0, totals.flows[flowTotalKey{src: otherFlow, dst: otherFlow, direction: iftop.FlowDirectionOut, srcZone: "private", dstZone: "private"}].bytes)
+	assert.Equal(t, 300.0, totals.flows[flowTotalKey{src: "all", dst: "all", direction: iftop.FlowDirectionOut, srcZone: "private", dstZone: "private"}].bytes)
+}
+
+func TestByteCountersPeers(t *testing.T) {
+	peers, err := parsePeerIndex([]byte(`{"version": 1, "peers": {"10.0.0.2": {"kind": "pod", "owner": "default/web"}}}`))
+	assert.NoError(t, err)
+
+	c := newByteCounters()
+	c.flowCounters = true
+	c.peers = &peerIndex{peers: peers, defaultZone: iftop.DefaultZone}
+	run := time.Now()
+	key := flowTotalKey{src: "10.0.0.1", dst: "10.0.0.2", direction: iftop.FlowDirectionOut, srcZone: "private", dstZone: "private"}
+
+	c.observe("eth0", newRoundState(run, 1, 100, newOutFlow("10.0.0.2", 100)))
+
+	// the peer of the flow is re-resolved, the total keeps growing under the first resolved peer
+	peers, err = parsePeerIndex([]byte(`{"version": 1, "peers": {"10.0.0.2": {"kind": "service", "owner": "default/frontend"}}}`))
+	assert.NoError(t, err)
+	c.peers.set(peers)
+	c.observe("eth0", newRoundState(run, 2, 150, newOutFlow("10.0.0.2", 150)))
+
+	totals, ok := c.totalsOf("eth0")
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(totals.flows), "the flow and its \"all\" total")
+	assert.Equal(t, 150.0, totals.flows[key].bytes)
+	assert.Equal(t, "default/web", totals.flows[key].peerOwner)
+	assert.Equal(t, "pod", totals.flows[key].peerKind)
+}
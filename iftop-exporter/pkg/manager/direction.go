@@ -0,0 +1,66 @@
+package manager
+
+import (
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+)
+
+// The keys of the dynamic interface info which the helper writes for the pod interfaces.
+const (
+	containerInterfaceNameKey = "container_interface_name"
+	nodeInterfaceNameKey      = "node_interface_name"
+)
+
+// WithPodDirection makes direction="out" mean the egress from the pod for the captures on the node side veths.
+//
+// The helper reports the node side peer of each pod interface, so the traffic which leaves the pod
+// is received by the veth, iftop reports it as "in" on the node side. With podDirection, the directions
+// (and the sent/received totals) of these interfaces are flipped, the other interfaces are not affected.
+func (mgr *Manager) WithPodDirection(podDirection bool) *Manager {
+	mgr.podDirection = podDirection
+	return mgr
+}
+
+// isNodeSidePeer reports whether the interface is the node side peer of a pod interface, by its dynamic interface info.
+func (mgr *Manager) isNodeSidePeer(interfaceName string) bool {
+	interfaceInfo := mgr.interfaceInfo(interfaceName)
+	return interfaceInfo[containerInterfaceNameKey] != "" && interfaceInfo[nodeInterfaceNameKey] == interfaceName
+}
+
+// ownerState returns the state from the perspective of the owner of the interface,
+// the state of a node side peer is flipped if WithPodDirection is enabled, see flipDirections.
+func (mgr *Manager) ownerState(interfaceName string, state iftop.State) iftop.State {
+	if !mgr.podDirection || state.FlowStats == nil || !mgr.isNodeSidePeer(interfaceName) {
+		return state
+	}
+	return flipDirections(state)
+}
+
+// flipDirections returns a copy of the state with the in and out directions swapped,
+// the state is a published snapshot, so it is not modified.
+func flipDirections(state iftop.State) iftop.State {
+	stats := *state.FlowStats
+
+	stats.Flows = make([]*iftop.Flow, 0, len(state.FlowStats.Flows))
+	for _, flow := range state.FlowStats.Flows {
+		if flow == nil {
+			continue
+		}
+		f := *flow
+		switch f.Direction {
+		case iftop.FlowDirectionIn:
+			f.Direction = iftop.FlowDirectionOut
+		case iftop.FlowDirectionOut:
+			f.Direction = iftop.FlowDirectionIn
+		}
+		stats.Flows = append(stats.Flows, &f)
+	}
+
+	stats.TotalSentLast2RateBits, stats.TotalRecvLast2RateBits = stats.TotalRecvLast2RateBits, stats.TotalSentLast2RateBits
+	stats.TotalSentLast10RateBits, stats.TotalRecvLast10RateBits = stats.TotalRecvLast10RateBits, stats.TotalSentLast10RateBits
+	stats.TotalSentLast40RateBits, stats.TotalRecvLast40RateBits = stats.TotalRecvLast40RateBits, stats.TotalSentLast40RateBits
+	stats.PeakSentRateBits, stats.PeakRecvRateBits = stats.PeakRecvRateBits, stats.PeakSentRateBits
+	stats.CumulativeSentBytes, stats.CumulativeRecvBytes = stats.CumulativeRecvBytes, stats.CumulativeSentBytes
+
+	state.FlowStats = &stats
+	return state
+}
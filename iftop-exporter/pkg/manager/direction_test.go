@@ -0,0 +1,71 @@
+package manager
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlipDirections(t *testing.T) {
+	state := newRoundState(time.Now(), 1, 100, newOutFlow("10.0.0.2", 100))
+	state.FlowStats.CumulativeRecvBytes = 300
+	state.FlowStats.PeakSentRateBits = 8
+
+	flipped := flipDirections(state)
+	assert.Equal(t, iftop.FlowDirectionIn, flipped.FlowStats.Flows[0].Direction)
+	assert.Equal(t, 300.0, flipped.FlowStats.CumulativeSentBytes)
+	assert.Equal(t, 100.0, flipped.FlowStats.CumulativeRecvBytes)
+	assert.Equal(t, 8.0, flipped.FlowStats.PeakRecvRateBits)
+
+	// the published snapshot is not modified
+	assert.Equal(t, iftop.FlowDirectionOut, state.FlowStats.Flows[0].Direction)
+	assert.Equal(t, 100.0, state.FlowStats.CumulativeSentBytes)
+}
+
+func TestCollectorPodDirection(t *testing.T) {
+	mgr, err := NewManager(nil, true, "")
+	assert.NoError(t, err)
+
+	for _, interfaceName := range []string{"veth0", "eth0"} {
+		source := newFakeSource(interfaceName, 0)
+		source.state = newRoundState(time.Now(), 1, 100, newOutFlow("10.0.0.2", 100))
+		mgr.tasks[interfaceName] = source
+	}
+	// the node side peer of the pod interface
+	mgr.dynamicInterfaceInfo["veth0"] = map[string]string{
+		"owner":                    "default/nginx-0",
+		"container_interface_name": "eth0",
+		"node_interface_name":      "veth0",
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(mgr.Collector())
+
+	expected := `
+# HELP iftop_bytes_total total bytes of all flows observed by iftop runs, it survives iftop restarts, the traffic between runs is not observed
+# TYPE iftop_bytes_total counter
+iftop_bytes_total{direction="in",interface="eth0",owner=""} 0
+iftop_bytes_total{direction="in",interface="veth0",owner="default/nginx-0"} 100
+iftop_bytes_total{direction="out",interface="eth0",owner=""} 100
+iftop_bytes_total{direction="out",interface="veth0",owner="default/nginx-0"} 0
+# HELP iftop_flow_cumulative_bytes cumulative bytes of the flow
+# TYPE iftop_flow_cumulative_bytes gauge
+iftop_flow_cumulative_bytes{direction="in",dst="10.0.0.2",dst_port="",dst_zone="private",interface="veth0",owner="default/nginx-0",peer_kind="",peer_owner="",src="10.0.0.1",src_port="",src_zone="private"} 100
+iftop_flow_cumulative_bytes{direction="out",dst="10.0.0.2",dst_port="",dst_zone="private",interface="eth0",owner="",peer_kind="",peer_owner="",src="10.0.0.1",src_port="",src_zone="private"} 100
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"iftop_bytes_total", "iftop_flow_cumulative_bytes"))
+
+	// the raw directions are reported without WithPodDirection
+	mgr, err = NewManager(nil, true, "")
+	assert.NoError(t, err)
+	mgr.WithPodDirection(false)
+	mgr.dynamicInterfaceInfo["veth0"] = map[string]string{"container_interface_name": "eth0", "node_interface_name": "veth0"}
+	state := newRoundState(time.Now(), 1, 100, newOutFlow("10.0.0.2", 100))
+	assert.Equal(t, state, mgr.ownerState("veth0", state))
+}
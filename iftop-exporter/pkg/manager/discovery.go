@@ -0,0 +1,167 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// DefaultDiscoverExclude is the default exclude pattern of the auto-discovery,
+// the loopback and the pod veths (which are reported by the helper with their owners).
+const DefaultDiscoverExclude = "lo|veth.*"
+
+// LinkFilter selects the links to capture on for the auto-discovery.
+type LinkFilter struct {
+	// Include matches the whole link name, nil means all links.
+	Include *regexp.Regexp
+	// Exclude matches the whole link name, it wins over Include, nil means no link.
+	Exclude *regexp.Regexp
+	// Types are the link types (e.g. device, bond, vlan, bridge, veth), empty means all types.
+	Types []string
+}
+
+// NewLinkFilter creates the LinkFilter from the include and exclude regexes which must match the whole
+// link name (e.g. "eth.*|bond.*"), and the comma separated link types, the empty values match all links.
+func NewLinkFilter(include string, exclude string, types string) (*LinkFilter, error) {
+	filter := &LinkFilter{}
+
+	var err error
+	if include != "" {
+		if filter.Include, err = regexp.Compile("^(?:" + include + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid discover include (%s), err: %s", include, err)
+		}
+	}
+	if exclude != "" {
+		if filter.Exclude, err = regexp.Compile("^(?:" + exclude + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid discover exclude (%s), err: %s", exclude, err)
+		}
+	}
+
+	for _, linkType := range strings.Split(types, ",") {
+		if linkType = strings.TrimSpace(linkType); linkType != "" {
+			filter.Types = append(filter.Types, linkType)
+		}
+	}
+
+	return filter, nil
+}
+
+// Match reports whether the link should be captured on.
+func (f *LinkFilter) Match(interfaceName string, linkType string) bool {
+	if f.Exclude != nil && f.Exclude.MatchString(interfaceName) {
+		return false
+	}
+	if f.Include != nil && !f.Include.MatchString(interfaceName) {
+		return false
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, linkType) {
+		return false
+	}
+	return true
+}
+
+// WithDiscovery starts and stops the tasks for the links selected by filter, as the links come and go.
+func (mgr *Manager) WithDiscovery(filter *LinkFilter) *Manager {
+	mgr.discovery = filter
+	return mgr
+}
+
+// watchLinks follows the link updates until the Manager shuts down, it starts and stops the tasks
+// of the discovered links, and resumes the parked tasks when their links reappear.
+func (mgr *Manager) watchLinks() {
+	updates := make(chan netlink.LinkUpdate)
+	options := netlink.LinkSubscribeOptions{
+		// the existing links are reported first, so they are discovered at start
+		ListExisting: mgr.discovery != nil,
+		ErrorCallback: func(err error) {
+			log.Printf("receive link updates failed, err: %s", err)
+		},
+	}
+	// the existing links are known, so their updates (e.g. the stats) do not resume the parked tasks
+	if links, err := netlink.LinkList(); err != nil {
+		log.Printf("list links failed, err: %s", err)
+	} else {
+		mgr.lock.Lock()
+		for _, link := range links {
+			mgr.links[link.Attrs().Name] = link.Attrs().Flags&net.FlagUp != 0
+		}
+		mgr.lock.Unlock()
+	}
+
+	if err := netlink.LinkSubscribeWithOptions(updates, mgr.done, options); err != nil {
+		log.Printf("subscribe link updates failed, the links are not discovered, and the parked tasks are only resumed by their dynamic files, err: %s", err)
+		return
+	}
+
+	for update := range updates {
+		attrs := update.Attrs()
+
+		// the deletion of the link is also an update
+		exists, err := linkExists(attrs.Name)
+		if err != nil {
+			log.Printf("call LinkByName failed, err: %s", err)
+			continue
+		}
+
+		mgr.handleLink(attrs.Name, update.Type(), exists, attrs.Flags&net.FlagUp != 0)
+	}
+}
+
+// handleLink reacts to an update of the link.
+// The parked task of the link is resumed only if the link reappears or comes up,
+// the other updates (e.g. the flags, the MTU and the stats) are no chance for it.
+func (mgr *Manager) handleLink(interfaceName string, linkType string, exists bool, up bool) {
+	mgr.lock.Lock()
+	wasUp, known := mgr.links[interfaceName]
+	if exists {
+		mgr.links[interfaceName] = up
+	} else {
+		delete(mgr.links, interfaceName)
+	}
+	mgr.lock.Unlock()
+	reappeared := exists && (!known || (up && !wasUp))
+
+	if mgr.isStaticInterface(interfaceName) {
+		if reappeared {
+			mgr.resume(interfaceName)
+		}
+		return
+	}
+
+	mgr.lock.Lock()
+	_, running := mgr.removeChs[interfaceName]
+	_, dynamic := mgr.dynamicInterfaceInfo[interfaceName]
+	discovered := mgr.discovered[interfaceName]
+	mgr.lock.Unlock()
+
+	if !exists {
+		// stop at once, instead of waiting for iftop to fail on the deleted link
+		if running && (discovered || dynamic) {
+			log.Printf("link of interface (%s) deleted, try to stop iftop task", interfaceName)
+			mgr.stop(interfaceName)
+		}
+		mgr.lock.Lock()
+		delete(mgr.discovered, interfaceName)
+		mgr.lock.Unlock()
+		return
+	}
+
+	if reappeared {
+		mgr.resume(interfaceName)
+	}
+
+	if running || mgr.discovery == nil || !up || !mgr.discovery.Match(interfaceName, linkType) {
+		return
+	}
+
+	mgr.lock.Lock()
+	mgr.discovered[interfaceName] = true
+	mgr.lock.Unlock()
+	log.Printf("link of interface (%s, %s) discovered, try to start iftop task", interfaceName, linkType)
+	mgr.start(interfaceName)
+}
@@ -0,0 +1,140 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkFilter(t *testing.T) {
+	filter, err := NewLinkFilter("eth.*|bond.*", DefaultDiscoverExclude, "")
+	assert.NoError(t, err)
+	assert.True(t, filter.Match("eth0", "device"))
+	assert.True(t, filter.Match("bond0", "bond"))
+	assert.False(t, filter.Match("lo", "device"))
+	assert.False(t, filter.Match("veth1234", "veth"))
+	assert.False(t, filter.Match("myeth0", "device"), "the include must match the whole name")
+
+	filter, err = NewLinkFilter("", "lo", "device, vlan")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"device", "vlan"}, filter.Types)
+	assert.True(t, filter.Match("eno1", "device"))
+	assert.True(t, filter.Match("eno1.100", "vlan"))
+	assert.False(t, filter.Match("br0", "bridge"))
+	assert.False(t, filter.Match("lo", "device"))
+
+	// everything
+	filter, err = NewLinkFilter("", "", "")
+	assert.NoError(t, err)
+	assert.True(t, filter.Match("lo", "device"))
+
+	_, err = NewLinkFilter("eth[", "", "")
+	assert.Error(t, err)
+	_, err = NewLinkFilter("", "(", "")
+	assert.Error(t, err)
+}
+
+func TestManagerHandleLink(t *testing.T) {
+	factory := &fakeFactory{runFor: time.Hour}
+
+	mgr, err := NewManager([]string{"eth0"}, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 0, 0)
+	mgr.WithFlowSourceFactory(factory.newSource)
+	filter, err := NewLinkFilter("eth.*|bond.*", DefaultDiscoverExclude, "")
+	assert.NoError(t, err)
+	mgr.WithDiscovery(filter)
+
+	hasTask := func(interfaceName string) bool {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		_, ok := mgr.removeChs[interfaceName]
+		return ok
+	}
+
+	// the matched links are started once they are up
+	mgr.handleLink("bond0", "bond", true, false)
+	mgr.handleLink("veth0", "veth", true, true)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, hasTask("bond0"), "the link is down")
+	assert.False(t, hasTask("veth0"), "the link is excluded")
+
+	mgr.handleLink("bond0", "bond", true, true)
+	mgr.handleLink("eth1", "device", true, true)
+	assert.Eventually(t, func() bool {
+		return hasTask("bond0") && hasTask("eth1")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the repeated updates of a running link start nothing
+	mgr.handleLink("bond0", "bond", true, true)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, factory.created())
+
+	// the deletion stops the task at once, a repeated deletion does no harm
+	mgr.handleLink("bond0", "bond", false, false)
+	mgr.handleLink("bond0", "bond", false, false)
+	assert.Eventually(t, func() bool {
+		return !hasTask("bond0")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, hasTask("eth1"))
+
+	// the static interfaces are left to the backoff
+	mgr.handleLink("eth0", "device", true, true)
+	mgr.static()
+	assert.Eventually(t, func() bool {
+		return hasTask("eth0")
+	}, 5*time.Second, 10*time.Millisecond)
+	mgr.handleLink("eth0", "device", false, false)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, hasTask("eth0"))
+
+	// the reappeared link is started again
+	mgr.handleLink("bond0", "bond", true, true)
+	assert.Eventually(t, func() bool {
+		return hasTask("bond0")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the task removed by other means (e.g. the dynamic file) is no longer discovered
+	mgr.stop("bond0")
+	assert.Eventually(t, func() bool {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		return !mgr.discovered["bond0"]
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mgr.stop("eth0")
+	mgr.stop("eth1")
+}
+
+func TestManagerHandleLinkResume(t *testing.T) {
+	mgr, err := NewManager([]string{"eth0"}, false, "")
+	assert.NoError(t, err)
+
+	// resumedBy reports whether the parked task is resumed by the update
+	resumedBy := func(update func()) bool {
+		resumeCh := make(chan struct{})
+		mgr.lock.Lock()
+		mgr.resumeChs["eth0"] = resumeCh
+		mgr.lock.Unlock()
+
+		update()
+
+		select {
+		case <-resumeCh:
+			return true
+		default:
+			mgr.lock.Lock()
+			delete(mgr.resumeChs, "eth0")
+			mgr.lock.Unlock()
+			return false
+		}
+	}
+
+	assert.True(t, resumedBy(func() { mgr.handleLink("eth0", "device", true, false) }), "the link appears")
+	assert.False(t, resumedBy(func() { mgr.handleLink("eth0", "device", true, false) }), "e.g. the stats changed")
+	assert.True(t, resumedBy(func() { mgr.handleLink("eth0", "device", true, true) }), "the link comes up")
+	assert.False(t, resumedBy(func() { mgr.handleLink("eth0", "device", true, true) }), "e.g. the MTU changed")
+	assert.False(t, resumedBy(func() { mgr.handleLink("eth0", "device", false, false) }), "the link is deleted")
+	assert.True(t, resumedBy(func() { mgr.handleLink("eth0", "device", true, true) }), "the link reappears")
+}
@@ -0,0 +1,139 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// DefaultResyncInterval is the default interval of the scans of the dynamic dir.
+const DefaultResyncInterval = time.Minute
+
+// WithResyncInterval sets how often the dynamic dir is scanned to reconcile the tasks, 0 means only at start.
+func (mgr *Manager) WithResyncInterval(interval time.Duration) *Manager {
+	mgr.resyncInterval = interval
+	return mgr
+}
+
+// isHiddenFile reports whether the file in the dynamic dir is not an interface file,
+// e.g. the watching file, and the temp files of the atomic writes.
+func isHiddenFile(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// linkExists reports whether the link of the interface exists.
+func linkExists(interfaceName string) (bool, error) {
+	if _, err := netlink.LinkByName(interfaceName); err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// addDynamic reads the interface info and the capture options from the file, and starts the task of the interface
+// if it is not running. Invalid capture options are ignored, the running task keeps its options,
+// and a new task is started with the global options.
+func (mgr *Manager) addDynamic(interfaceName string, fileName string) error {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("read file failed for interface (%s), err: %s", interfaceName, err)
+	}
+
+	interfaceInfo, err := parseInterfaceInfo(b)
+	if err != nil {
+		return fmt.Errorf("json unmarshal failed for interface (%s), err: %s", interfaceName, err)
+	}
+
+	capture, err := parseInterfaceFile(b)
+	if err == nil && capture != nil {
+		err = capture.Valid(mgr.continuous, mgr.interval)
+	}
+
+	mgr.lock.Lock()
+	_, running := mgr.removeChs[interfaceName]
+	mgr.lock.Unlock()
+
+	if err != nil {
+		if running {
+			return fmt.Errorf("invalid capture options for interface (%s), the task keeps its current options, err: %s", interfaceName, err)
+		}
+		log.Printf("invalid capture options for interface (%s), start it with the global options, err: %s", interfaceName, err)
+		capture = nil
+	}
+	mgr.setCaptureOptions(interfaceName, capture)
+
+	mgr.lock.Lock()
+	mgr.dynamicInterfaceInfo[interfaceName] = interfaceInfo
+	mgr.lock.Unlock()
+
+	if !running {
+		owner := interfaceInfo["owner"]
+		log.Printf("try to start iftop for interface (%s, %s)", interfaceName, owner)
+		mgr.start(interfaceName)
+	}
+	return nil
+}
+
+// resync reconciles the tasks with the dynamic dir: the interfaces whose files are present and whose links exist
+// are started, the tasks of the dynamic interfaces whose files vanished or whose links are gone are stopped.
+// The peer index file is reloaded as well.
+func (mgr *Manager) resync() {
+	mgr.loadPeers()
+
+	entries, err := os.ReadDir(mgr.dynamicDir)
+	if err != nil {
+		log.Printf("resync: read dynamic dir (%s) failed, err: %s", mgr.dynamicDir, err)
+		return
+	}
+
+	desired := map[string]bool{}
+	for _, entry := range entries {
+		interfaceName := entry.Name()
+		if isHiddenFile(interfaceName) || !entry.Type().IsRegular() || mgr.isStaticInterface(interfaceName) {
+			continue
+		}
+
+		exists, err := linkExists(interfaceName)
+		if err != nil {
+			log.Printf("resync: call LinkByName failed, err: %s", err)
+			// unknown, do not stop it
+			desired[interfaceName] = true
+			continue
+		}
+		if !exists {
+			mgr.Debugf("resync: not found link for interface (%s)", interfaceName)
+			continue
+		}
+
+		desired[interfaceName] = true
+		if err := mgr.addDynamic(interfaceName, filepath.Join(mgr.dynamicDir, interfaceName)); err != nil {
+			log.Printf("resync: %s", err)
+		}
+	}
+
+	mgr.lock.Lock()
+	stale := []string{}
+	for interfaceName := range mgr.dynamicInterfaceInfo {
+		if desired[interfaceName] {
+			continue
+		}
+		if _, running := mgr.removeChs[interfaceName]; running {
+			stale = append(stale, interfaceName)
+		} else {
+			delete(mgr.dynamicInterfaceInfo, interfaceName)
+		}
+	}
+	mgr.lock.Unlock()
+
+	for _, interfaceName := range stale {
+		log.Printf("resync: file or link of interface (%s) vanished, try to stop iftop task", interfaceName)
+		mgr.stop(interfaceName)
+	}
+}
@@ -0,0 +1,142 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the tests use the loopback, which is the only link known to exist
+const existingLink = "lo"
+
+func TestManagerResync(t *testing.T) {
+	if exists, err := linkExists(existingLink); err != nil || !exists {
+		t.Skipf("link (%s) is not available, err: %v", existingLink, err)
+	}
+
+	factory := &fakeFactory{runFor: time.Hour}
+	dynamicDir := t.TempDir()
+
+	mgr, err := NewManager(nil, true, dynamicDir)
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 0, 0)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	hasTask := func(interfaceName string) bool {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		_, ok := mgr.removeChs[interfaceName]
+		return ok
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dynamicDir, existingLink), []byte(`{"owner": "default/pod0"}`), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dynamicDir, "nosuchlink0"), []byte(`{"owner": "default/pod1"}`), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dynamicDir, ".nosuchlink1.tmp"), []byte(`{}`), 0o644))
+
+	mgr.resync()
+	assert.Eventually(t, func() bool {
+		return hasTask(existingLink)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string]string{"owner": "default/pod0"}, mgr.interfaceInfo(existingLink))
+	assert.False(t, hasTask("nosuchlink0"), "the link does not exist")
+	assert.False(t, hasTask(".nosuchlink1.tmp"), "the hidden files are ignored")
+
+	// a repeated scan starts nothing
+	mgr.resync()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, factory.created())
+
+	// the vanished file stops the task
+	assert.NoError(t, os.Remove(filepath.Join(dynamicDir, existingLink)))
+	mgr.resync()
+	assert.Eventually(t, func() bool {
+		return !hasTask(existingLink)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestManagerWatchExistingAndRenamedFiles(t *testing.T) {
+	if exists, err := linkExists(existingLink); err != nil || !exists {
+		t.Skipf("link (%s) is not available, err: %v", existingLink, err)
+	}
+
+	factory := &fakeFactory{runFor: time.Hour}
+	dynamicDir := t.TempDir()
+	fileName := filepath.Join(dynamicDir, existingLink)
+
+	// written before the exporter starts
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"owner": "default/pod0"}`), 0o644))
+
+	mgr, err := NewManager(nil, true, dynamicDir)
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 0, 0)
+	mgr.WithFlowSourceFactory(factory.newSource)
+	mgr.WithResyncInterval(0)
+
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- mgr.Run()
+	}()
+	defer func() {
+		assert.NoError(t, mgr.Shutdown(5*time.Second))
+		<-runErrCh
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(mgr.sources()) == 1
+	}, 5*time.Second, 10*time.Millisecond, "the existing file is picked up at start")
+
+	// an atomic write renames a hidden temp file over the interface file
+	tmpName := filepath.Join(dynamicDir, "."+existingLink+".tmp")
+	assert.NoError(t, os.WriteFile(tmpName, []byte(`{"owner": "default/pod1"}`), 0o644))
+	assert.NoError(t, os.Rename(tmpName, fileName))
+	assert.Eventually(t, func() bool {
+		return mgr.interfaceInfo(existingLink)["owner"] == "default/pod1"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, mgr.sources(), 1)
+
+	// the interface file moved away stops the task
+	assert.NoError(t, os.Rename(fileName, filepath.Join(dynamicDir, ".moved")))
+	assert.Eventually(t, func() bool {
+		return len(mgr.sources()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestManagerAddDynamicInvalidCapture(t *testing.T) {
+	factory := &fakeFactory{runFor: time.Hour}
+	dynamicDir := t.TempDir()
+
+	mgr, err := NewManager(nil, true, dynamicDir)
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 0, 0)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	captureOf := func(interfaceName string) *CaptureOptions {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		return mgr.captureOverrides[interfaceName]
+	}
+
+	// a new interface with a bad capture block is started with the global options
+	fileName := filepath.Join(dynamicDir, "veth0")
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"owner": "default/pod0", "capture": {"sort_by": "1m"}}`), 0o644))
+	assert.NoError(t, mgr.addDynamic("veth0", fileName))
+	assert.Eventually(t, func() bool {
+		return len(mgr.sources()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, captureOf("veth0"))
+	assert.Equal(t, "default/pod0", mgr.interfaceInfo("veth0")["owner"])
+
+	// the running task keeps its options
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"owner": "default/pod0", "capture": {"sort_by": "10s"}}`), 0o644))
+	assert.NoError(t, mgr.addDynamic("veth0", fileName))
+	assert.Equal(t, &CaptureOptions{SortBy: "10s"}, captureOf("veth0"))
+
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"owner": "default/pod0", "capture": {"no_such_option": true}}`), 0o644))
+	assert.Error(t, mgr.addDynamic("veth0", fileName))
+	assert.Equal(t, &CaptureOptions{SortBy: "10s"}, captureOf("veth0"))
+
+	mgr.stop("veth0")
+}
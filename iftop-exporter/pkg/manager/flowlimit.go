@@ -0,0 +1,178 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The windows to rank the flows by, see FlowLimits.TopBy.
+const (
+	TopBy2s         = "2s"
+	TopBy10s        = "10s"
+	TopBy40s        = "40s"
+	TopByCumulative = "cumulative"
+)
+
+// The reasons why a flow is folded into the "other" flow.
+const (
+	FoldReasonTopK      = "top_k"
+	FoldReasonMaxSeries = "max_series"
+)
+
+// otherFlow is the src and dst of the flow which sums up the folded flows.
+const otherFlow = "other"
+
+// FlowLimits bounds the number of the flow series.
+//
+// The flows are ranked by the TopBy window (the sum of both directions of a src/dst pair),
+// each interface keeps its TopK pairs, then all interfaces share the MaxSeries budget in the order of the rank.
+// The flows out of the limits are summed up into the src="other",dst="other" flow of the interface,
+// the "all" flows and the "other" flows are always kept and not counted.
+type FlowLimits struct {
+	// TopK is the max number of the src/dst pairs of each interface, 0 means unlimited.
+	TopK int
+	// TopBy is the window to rank the flows by, see TopBy* constants.
+	TopBy string
+	// MaxSeries is the max number of the flow series of all interfaces, 0 means unlimited.
+	MaxSeries int
+}
+
+func (l FlowLimits) Valid() error {
+	if l.TopK < 0 {
+		return fmt.Errorf("invalid flow top k (%d), must not be negative", l.TopK)
+	}
+	if l.MaxSeries < 0 {
+		return fmt.Errorf("invalid flow max series (%d), must not be negative", l.MaxSeries)
+	}
+
+	switch l.TopBy {
+	case "", TopBy2s, TopBy10s, TopBy40s, TopByCumulative:
+	default:
+		return fmt.Errorf("invalid flow top by (%s), valid values are: %s, %s, %s, %s", l.TopBy, TopBy2s, TopBy10s, TopBy40s, TopByCumulative)
+	}
+
+	return nil
+}
+
+func (l FlowLimits) rankValue(sample *flowSample) float64 {
+	switch l.TopBy {
+	case TopBy10s:
+		return sample.last10
+	case TopBy40s:
+		return sample.last40
+	case TopByCumulative:
+		return sample.cumulative
+	default:
+		return sample.last2
+	}
+}
+
+// flowPair holds the samples of both directions of a src/dst pair.
+type flowPair struct {
+	interfaceName string
+	src           string
+	dst           string
+	samples       []*flowSample
+	rank          float64
+}
+
+// limitedFlows holds the flow samples of an interface after the limits are applied.
+type limitedFlows struct {
+	samples []*flowSample
+	// folded is the number of the src/dst pairs folded into the "other" flow, for each fold reason.
+	folded map[string]int
+}
+
+// limitFlows applies the limits to the flow samples of each interface.
+func (l FlowLimits) limitFlows(samplesByInterface map[string][]*flowSample) map[string]*limitedFlows {
+	result := make(map[string]*limitedFlows, len(samplesByInterface))
+	kept := []*flowPair{}
+
+	for interfaceName, samples := range samplesByInterface {
+		limited := &limitedFlows{folded: map[string]int{}}
+		result[interfaceName] = limited
+
+		pairs := []*flowPair{}
+		index := map[[2]string]*flowPair{}
+		for _, sample := range samples {
+			if sample.src == "all" || sample.src == otherFlow {
+				limited.samples = append(limited.samples, sample)
+				continue
+			}
+
+			key := [2]string{sample.src, sample.dst}
+			pair, ok := index[key]
+			if !ok {
+				pair = &flowPair{interfaceName: interfaceName, src: sample.src, dst: sample.dst}
+				index[key] = pair
+				pairs = append(pairs, pair)
+			}
+			pair.samples = append(pair.samples, sample)
+			pair.rank += l.rankValue(sample)
+		}
+		sortFlowPairs(pairs)
+
+		for i, pair := range pairs {
+			if l.TopK > 0 && i >= l.TopK {
+				limited.fold(pair, FoldReasonTopK)
+				continue
+			}
+			kept = append(kept, pair)
+		}
+	}
+
+	sortFlowPairs(kept)
+	series := 0
+	for _, pair := range kept {
+		limited := result[pair.interfaceName]
+		if l.MaxSeries > 0 && series+len(pair.samples) > l.MaxSeries {
+			limited.fold(pair, FoldReasonMaxSeries)
+			continue
+		}
+		series += len(pair.samples)
+		limited.samples = append(limited.samples, pair.samples...)
+	}
+
+	return result
+}
+
+// fold sums up the samples of the pair into the "other" flows of the same direction and zones.
+func (limited *limitedFlows) fold(pair *flowPair, reason string) {
+	limited.folded[reason]++
+
+	for _, sample := range pair.samples {
+		var other *flowSample
+		for _, s := range limited.samples {
+			if s.src == otherFlow && s.direction == sample.direction && s.srcZone == sample.srcZone && s.dstZone == sample.dstZone {
+				other = s
+				break
+			}
+		}
+		if other == nil {
+			other = &flowSample{src: otherFlow, dst: otherFlow, direction: sample.direction, srcZone: sample.srcZone, dstZone: sample.dstZone}
+			limited.samples = append(limited.samples, other)
+		}
+
+		other.last2 += sample.last2
+		other.last10 += sample.last10
+		other.last40 += sample.last40
+		other.cumulative += sample.cumulative
+	}
+}
+
+// sortFlowPairs sorts the pairs by rank in descending order, the ties are sorted by names to be stable across scrapes.
+func sortFlowPairs(pairs []*flowPair) {
+	sort.SliceStable(pairs, func(i, j int) bool {
+		a, b := pairs[i], pairs[j]
+		if a.rank != b.rank {
+			return a.rank > b.rank
+		}
+		if a.interfaceName != b.interfaceName {
+			return a.interfaceName < b.interfaceName
+		}
+		if a.src != b.src {
+			return a.src < b.src
+		}
+		return a.dst < b.dst
+	})
+}
@@ -0,0 +1,75 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPairSamples(src string, dst string, last2 float64) []*flowSample {
+	return []*flowSample{
+		{src: src, dst: dst, direction: "out", srcZone: "private", dstZone: "private", last2: last2, cumulative: last2},
+		{src: src, dst: dst, direction: "in", srcZone: "private", dstZone: "private", last2: last2, cumulative: last2},
+	}
+}
+
+func sampleKeys(samples []*flowSample) []string {
+	keys := []string{}
+	for _, sample := range samples {
+		keys = append(keys, sample.src+">"+sample.dst+":"+sample.direction)
+	}
+	return keys
+}
+
+func TestFlowLimitsTopK(t *testing.T) {
+	samples := []*flowSample{}
+	samples = append(samples, newPairSamples("10.0.0.1", "10.0.0.2", 10)...)
+	samples = append(samples, newPairSamples("10.0.0.1", "10.0.0.3", 30)...)
+	samples = append(samples, newPairSamples("10.0.0.1", "10.0.0.4", 20)...)
+	samples = append(samples, &flowSample{src: "all", dst: "all", direction: "out", srcZone: "private", dstZone: "private", last2: 60})
+
+	limits := FlowLimits{TopK: 2}
+	limited := limits.limitFlows(map[string][]*flowSample{"eth0": samples})["eth0"]
+
+	assert.Equal(t, []string{
+		"all>all:out",
+		"other>other:out", "other>other:in",
+		"10.0.0.1>10.0.0.3:out", "10.0.0.1>10.0.0.3:in",
+		"10.0.0.1>10.0.0.4:out", "10.0.0.1>10.0.0.4:in",
+	}, sampleKeys(limited.samples))
+	assert.Equal(t, 10.0, limited.samples[1].last2)
+	assert.Equal(t, 10.0, limited.samples[1].cumulative)
+	assert.Equal(t, map[string]int{FoldReasonTopK: 1}, limited.folded)
+
+	// no limits keep all flows
+	limited = FlowLimits{}.limitFlows(map[string][]*flowSample{"eth0": samples})["eth0"]
+	assert.Len(t, limited.samples, len(samples))
+	assert.Empty(t, limited.folded)
+}
+
+func TestFlowLimitsMaxSeries(t *testing.T) {
+	eth0 := append(newPairSamples("10.0.0.1", "10.0.0.2", 10), newPairSamples("10.0.0.1", "10.0.0.3", 40)...)
+	eth1 := append(newPairSamples("10.0.1.1", "10.0.1.2", 30), newPairSamples("10.0.1.1", "10.0.1.3", 20)...)
+
+	// the budget is shared in the order of the rank across interfaces
+	limits := FlowLimits{MaxSeries: 4, TopBy: TopByCumulative}
+	limited := limits.limitFlows(map[string][]*flowSample{"eth0": eth0, "eth1": eth1})
+
+	assert.ElementsMatch(t, []string{
+		"other>other:out", "other>other:in",
+		"10.0.0.1>10.0.0.3:out", "10.0.0.1>10.0.0.3:in",
+	}, sampleKeys(limited["eth0"].samples))
+	assert.ElementsMatch(t, []string{
+		"other>other:out", "other>other:in",
+		"10.0.1.1>10.0.1.2:out", "10.0.1.1>10.0.1.2:in",
+	}, sampleKeys(limited["eth1"].samples))
+	assert.Equal(t, map[string]int{FoldReasonMaxSeries: 1}, limited["eth0"].folded)
+	assert.Equal(t, map[string]int{FoldReasonMaxSeries: 1}, limited["eth1"].folded)
+}
+
+func TestFlowLimitsValid(t *testing.T) {
+	assert.NoError(t, FlowLimits{TopK: 10, TopBy: TopBy40s, MaxSeries: 1000}.Valid())
+	assert.Error(t, FlowLimits{TopK: -1}.Valid())
+	assert.Error(t, FlowLimits{MaxSeries: -1}.Valid())
+	assert.Error(t, FlowLimits{TopBy: "1s"}.Valid())
+}
@@ -0,0 +1,190 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// DefaultReadyMinFreshRatio is the default min ratio of the fresh tasks for the Manager to be ready.
+const DefaultReadyMinFreshRatio = 0.5
+
+// HealthReport is the health of the Manager, served by the health handlers in JSON.
+type HealthReport struct {
+	// Healthy is false if the Manager can not recover by itself, a restart may help.
+	Healthy bool `json:"healthy"`
+	// Ready is false if the metrics are not complete.
+	Ready bool `json:"ready"`
+	// Reasons explains why the Manager is not healthy or not ready.
+	Reasons []string `json:"reasons,omitempty"`
+
+	Watcher    WatcherHealth    `json:"watcher"`
+	DynamicDir DynamicDirHealth `json:"dynamic_dir"`
+	Tasks      TasksHealth      `json:"tasks"`
+}
+
+type WatcherHealth struct {
+	Enabled bool   `json:"enabled"`
+	Running bool   `json:"running"`
+	Error   string `json:"error,omitempty"`
+}
+
+type DynamicDirHealth struct {
+	Path      string `json:"path,omitempty"`
+	Available bool   `json:"available"`
+	Error     string `json:"error,omitempty"`
+}
+
+type TasksHealth struct {
+	Total int `json:"total"`
+	// Fresh is the number of the tasks which completed a round within FreshWithin.
+	Fresh         int               `json:"fresh"`
+	FreshRatio    float64           `json:"fresh_ratio"`
+	MinFreshRatio float64           `json:"min_fresh_ratio"`
+	FreshWithin   string            `json:"fresh_within"`
+	Interfaces    []InterfaceHealth `json:"interfaces"`
+}
+
+type InterfaceHealth struct {
+	Interface string     `json:"interface"`
+	State     string     `json:"state"`
+	Round     uint64     `json:"round"`
+	LastRound *time.Time `json:"last_round,omitempty"`
+	Fresh     bool       `json:"fresh"`
+}
+
+// WithReadyMinFreshRatio sets the min ratio of the tasks which completed a round recently for the Manager to be ready.
+func (mgr *Manager) WithReadyMinFreshRatio(ratio float64) *Manager {
+	mgr.readyMinFreshRatio = ratio
+	return mgr
+}
+
+// setWatchStatus records whether the watcher is running, and the error it exited with.
+func (mgr *Manager) setWatchStatus(running bool, err error) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	mgr.watching = running
+	mgr.watchErr = err
+}
+
+// Health checks the watcher, the dynamic dir and the freshness of the tasks.
+func (mgr *Manager) Health() HealthReport {
+	now := time.Now()
+	report := HealthReport{Healthy: true, Ready: true}
+
+	mgr.lock.Lock()
+	report.Watcher = WatcherHealth{Enabled: mgr.dynamic, Running: mgr.watching}
+	if mgr.watchErr != nil {
+		report.Watcher.Error = mgr.watchErr.Error()
+	}
+	startedAt := mgr.startedAt
+	states := maps.Clone(mgr.taskStates)
+	mgr.lock.Unlock()
+
+	if mgr.dynamic {
+		if report.Watcher.Error != "" {
+			report.Healthy = false
+			report.Reasons = append(report.Reasons, fmt.Sprintf("watcher failed, err: %s", report.Watcher.Error))
+		} else if !report.Watcher.Running {
+			report.Ready = false
+			report.Reasons = append(report.Reasons, "watcher is not running")
+		}
+
+		report.DynamicDir = DynamicDirHealth{Path: mgr.dynamicDir}
+		if info, err := os.Stat(mgr.dynamicDir); err != nil {
+			report.DynamicDir.Error = err.Error()
+		} else if !info.IsDir() {
+			report.DynamicDir.Error = "not a directory"
+		} else {
+			report.DynamicDir.Available = true
+		}
+		if !report.DynamicDir.Available {
+			report.Healthy = false
+			report.Reasons = append(report.Reasons, fmt.Sprintf("dynamic dir (%s) is not available, err: %s", mgr.dynamicDir, report.DynamicDir.Error))
+		}
+	}
+
+	freshWithin := mgr.staleness()
+	if freshWithin <= 0 {
+		// the metrics never go stale, still a task without a round for this long is not fresh
+		freshWithin = mgr.defaultStaleness()
+	}
+	report.Tasks = TasksHealth{
+		MinFreshRatio: mgr.readyMinFreshRatio,
+		FreshWithin:   freshWithin.String(),
+		Interfaces:    []InterfaceHealth{},
+	}
+	for _, source := range mgr.sources() {
+		state := source.State()
+		health := InterfaceHealth{Interface: source.ID(), State: states[source.ID()], Round: state.Round}
+		if !state.RoundEnd.IsZero() {
+			lastRound := state.RoundEnd
+			health.LastRound = &lastRound
+			health.Fresh = now.Sub(state.RoundEnd) <= freshWithin
+		}
+
+		report.Tasks.Total++
+		if health.Fresh {
+			report.Tasks.Fresh++
+		}
+		report.Tasks.Interfaces = append(report.Tasks.Interfaces, health)
+	}
+	sort.Slice(report.Tasks.Interfaces, func(i, j int) bool {
+		return report.Tasks.Interfaces[i].Interface < report.Tasks.Interfaces[j].Interface
+	})
+
+	if report.Tasks.Total > 0 {
+		report.Tasks.FreshRatio = float64(report.Tasks.Fresh) / float64(report.Tasks.Total)
+
+		if report.Tasks.FreshRatio < report.Tasks.MinFreshRatio {
+			report.Ready = false
+			report.Reasons = append(report.Reasons, fmt.Sprintf("fresh ratio (%.2f) of tasks is below (%.2f)", report.Tasks.FreshRatio, report.Tasks.MinFreshRatio))
+		}
+
+		// all tasks are broken for a long time, e.g. iftop is crash-looping
+		if report.Tasks.Fresh == 0 && !startedAt.IsZero() && now.Sub(startedAt) > freshWithin {
+			report.Healthy = false
+			report.Reasons = append(report.Reasons, fmt.Sprintf("no task completed a round within (%s)", freshWithin))
+		}
+	}
+
+	if !report.Healthy {
+		report.Ready = false
+	}
+
+	return report
+}
+
+// HealthzHandler serves the liveness of the Manager, the status is 503 if it is not healthy.
+func (mgr *Manager) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		report := mgr.Health()
+		serveHealthReport(w, report, report.Healthy)
+	})
+}
+
+// ReadyzHandler serves the readiness of the Manager, the status is 503 if it is not ready.
+func (mgr *Manager) ReadyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		report := mgr.Health()
+		serveHealthReport(w, report, report.Ready)
+	})
+}
+
+func serveHealthReport(w http.ResponseWriter, report HealthReport, ok bool) {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("json marshal failed, err: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,83 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	mgr, err := NewManager(nil, true, t.TempDir())
+	assert.NoError(t, err)
+	mgr.WithContinuous(false, 10*time.Second, 3*time.Second)
+	mgr.startedAt = time.Now()
+
+	// the watcher has not started yet
+	report := mgr.Health()
+	assert.True(t, report.Healthy)
+	assert.False(t, report.Ready)
+
+	mgr.setWatchStatus(true, nil)
+	report = mgr.Health()
+	assert.True(t, report.Healthy)
+	assert.True(t, report.Ready, "no task is ready")
+
+	fresh := newFakeSource("eth0", 0)
+	fresh.state.Round = 1
+	fresh.state.RoundEnd = time.Now()
+	mgr.tasks["eth0"] = fresh
+	mgr.tasks["eth1"] = newFakeSource("eth1", 0)
+	mgr.tasks["eth2"] = newFakeSource("eth2", 0)
+
+	report = mgr.Health()
+	assert.True(t, report.Healthy)
+	assert.False(t, report.Ready)
+	assert.Equal(t, 3, report.Tasks.Total)
+	assert.Equal(t, 1, report.Tasks.Fresh)
+	assert.Equal(t, "eth0", report.Tasks.Interfaces[0].Interface)
+
+	mgr.WithReadyMinFreshRatio(0.3)
+	assert.True(t, mgr.Health().Ready)
+
+	// all tasks are stale for longer than the staleness bound
+	fresh.state.RoundEnd = time.Now().Add(-time.Hour)
+	mgr.startedAt = time.Now().Add(-time.Hour)
+	assert.False(t, mgr.Health().Healthy)
+
+	// the watcher failed
+	delete(mgr.tasks, "eth0")
+	delete(mgr.tasks, "eth1")
+	delete(mgr.tasks, "eth2")
+	mgr.setWatchStatus(false, errors.New("too many open files"))
+	report = mgr.Health()
+	assert.False(t, report.Healthy)
+	assert.Equal(t, "too many open files", report.Watcher.Error)
+}
+
+func TestHealthHandlers(t *testing.T) {
+	mgr, err := NewManager(nil, true, "/nonexistent/dynamic")
+	assert.NoError(t, err)
+	mgr.setWatchStatus(true, nil)
+
+	for _, handler := range []http.Handler{mgr.HealthzHandler(), mgr.ReadyzHandler()} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+		report := HealthReport{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		assert.False(t, report.DynamicDir.Available)
+		assert.NotEmpty(t, report.Reasons)
+	}
+
+	static, err := NewManager([]string{"eth0"}, false, "")
+	assert.NoError(t, err)
+	rec := httptest.NewRecorder()
+	static.ReadyzHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,123 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultInfoLabels is the default mapping of the dynamic interface info to the metric labels.
+const DefaultInfoLabels = "owner"
+
+var (
+	labelNameRegexp  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	invalidLabelChar = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	// reservedLabelNames are the labels set by the exporter itself.
+	reservedLabelNames = []string{"interface", "src", "dst", "direction", "src_zone", "dst_zone", "src_port", "dst_port", "peer_owner", "peer_kind", "reason"}
+)
+
+// InfoLabel maps a key of the dynamic interface info to a metric label.
+type InfoLabel struct {
+	// Key is the key of the flattened dynamic interface info, see parseInterfaceInfo.
+	Key string
+	// Label is the name of the metric label.
+	Label string
+}
+
+// ParseInfoLabels parses the comma separated mapping of the dynamic interface info to the metric labels.
+// Each item is `key` or `key=label`, if label is omitted, it is derived from key by replacing the
+// invalid characters with "_", e.g. "labels.app.kubernetes.io/name" becomes "labels_app_kubernetes_io_name".
+func ParseInfoLabels(s string) ([]InfoLabel, error) {
+	infoLabels := []InfoLabel{}
+	seen := map[string]bool{}
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		key, label, found := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		label = strings.TrimSpace(label)
+		if key == "" {
+			return nil, fmt.Errorf("invalid info label (%s), empty key", item)
+		}
+		if !found || label == "" {
+			label = invalidLabelChar.ReplaceAllString(key, "_")
+		}
+
+		if !labelNameRegexp.MatchString(label) || strings.HasPrefix(label, "__") {
+			return nil, fmt.Errorf("invalid info label (%s), label name (%s) is not valid", item, label)
+		}
+		for _, reserved := range reservedLabelNames {
+			if label == reserved {
+				return nil, fmt.Errorf("invalid info label (%s), label name (%s) is reserved", item, label)
+			}
+		}
+		if seen[label] {
+			return nil, fmt.Errorf("invalid info label (%s), duplicate label name (%s)", item, label)
+		}
+		seen[label] = true
+
+		infoLabels = append(infoLabels, InfoLabel{Key: key, Label: label})
+	}
+
+	return infoLabels, nil
+}
+
+// infoLabelNames returns the metric label names of the info labels.
+func infoLabelNames(infoLabels []InfoLabel) []string {
+	names := make([]string, 0, len(infoLabels))
+	for _, infoLabel := range infoLabels {
+		names = append(names, infoLabel.Label)
+	}
+	return names
+}
+
+// parseInterfaceInfo parses the dynamic interface info file into a flat map.
+// The nested objects are flattened with "." separated keys, e.g. {"labels": {"app": "nginx"}}
+// becomes {"labels.app": "nginx"}, the numbers and booleans are formatted as strings, null is ignored.
+// The version and the capture options are not the interface info.
+func parseInterfaceInfo(b []byte) (map[string]string, error) {
+	raw := map[string]any{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	// not the interface info, see parseInterfaceFile
+	delete(raw, interfaceFileVersionKey)
+	delete(raw, interfaceFileCaptureKey)
+
+	interfaceInfo := map[string]string{}
+	flattenInterfaceInfo(interfaceInfo, "", raw)
+	return interfaceInfo, nil
+}
+
+func flattenInterfaceInfo(interfaceInfo map[string]string, prefix string, raw map[string]any) {
+	for k, v := range raw {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+
+		switch value := v.(type) {
+		case string:
+			interfaceInfo[key] = value
+		case float64:
+			interfaceInfo[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			interfaceInfo[key] = strconv.FormatBool(value)
+		case map[string]any:
+			flattenInterfaceInfo(interfaceInfo, key, value)
+		case nil:
+		default:
+			// arrays can not be mapped to a label value
+			b, _ := json.Marshal(value)
+			interfaceInfo[key] = string(b)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInfoLabels(t *testing.T) {
+	infoLabels, err := ParseInfoLabels("owner, namespace,labels.app.kubernetes.io/name,labels.team=team")
+	assert.NoError(t, err)
+	assert.Equal(t, []InfoLabel{
+		{Key: "owner", Label: "owner"},
+		{Key: "namespace", Label: "namespace"},
+		{Key: "labels.app.kubernetes.io/name", Label: "labels_app_kubernetes_io_name"},
+		{Key: "labels.team", Label: "team"},
+	}, infoLabels)
+
+	infoLabels, err = ParseInfoLabels("")
+	assert.NoError(t, err)
+	assert.Empty(t, infoLabels)
+
+	for _, s := range []string{
+		"=owner",
+		"owner=1owner",
+		"owner=__owner",
+		"src",
+		"owner,pod=owner",
+	} {
+		_, err := ParseInfoLabels(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseInterfaceInfo(t *testing.T) {
+	interfaceInfo, err := parseInterfaceInfo([]byte(`{
+  "owner": "default/nginx-0",
+  "restarts": 3,
+  "host_network": false,
+  "labels": {"app": "nginx", "tier": {"name": "web"}},
+  "ports": [80, 443],
+  "node": null
+}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"owner":            "default/nginx-0",
+		"restarts":         "3",
+		"host_network":     "false",
+		"labels.app":       "nginx",
+		"labels.tier.name": "web",
+		"ports":            "[80,443]",
+	}, interfaceInfo)
+
+	_, err = parseInterfaceInfo([]byte(`[]`))
+	assert.Error(t, err)
+}
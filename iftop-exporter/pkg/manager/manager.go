@@ -1,7 +1,8 @@
 package manager
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -9,22 +10,83 @@ import (
 	"sync"
 	"time"
 
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/afpacket"
 	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/recorder"
 	"github.com/fsnotify/fsnotify"
-	"github.com/vishvananda/netlink"
 )
 
+// hangGracePeriod is added to the expected silence of an iftop run before it is regarded as hung,
+// e.g. iftop occasionally wedges on opening the pcap.
+const hangGracePeriod = 10 * time.Second
+
 // Manager manages how to start/stop iftop tasks for specified interfaces, and
 // how to update prometheus metrics by interpreting iftop state.
 type Manager struct {
-	tasks     map[string]*iftop.Task // key is interfaceName
-	removeChs map[string]chan int    // key is interfaceName
+	tasks     map[string]FlowSource // key is interfaceName
+	removeChs map[string]chan int   // key is interfaceName
+	// running are the sources whose run is in progress, key is interfaceName.
+	// In periodic mode, the running source is cached in tasks only after it exits.
+	running map[string]FlowSource
+	// taskStates is the state of each task, see TaskState* constants, key is interfaceName.
+	taskStates map[string]string
+	// resumeChs are closed to resume the parked tasks, key is interfaceName.
+	resumeChs map[string]chan struct{}
+	// discovered are the interfaces started by the auto-discovery, key is interfaceName.
+	discovered map[string]bool
+	// links are the known links and whether they are up, key is interfaceName, see handleLink.
+	links map[string]bool
+	// runStarts is the start time of the latest run, key is interfaceName.
+	runStarts map[string]time.Time
 	lock      sync.Mutex
 
+	// scheduler limits the number of the concurrent captures.
+	scheduler *scheduler
+
+	// newSource creates the capture backend for each run, defaults to newIftopTask.
+	newSource FlowSourceFactory
+
 	staticInterfaceNames []string
 	dynamic              bool
 	dynamicDir           string
 	dynamicInterfaceInfo map[string]map[string]string // labels for each interfaceName
+	// captureDefaults are the capture options of all interfaces, see WithCaptureOptions.
+	captureDefaults *CaptureOptions
+	// captureOverrides are the capture options carried in the dynamic interface files, key is interfaceName.
+	captureOverrides map[string]*CaptureOptions
+	// restarting are the interfaces whose runs are stopped to apply the changed capture options.
+	restarting map[string]bool
+	// discovery selects the links to start the tasks for, nil means the auto-discovery is disabled.
+	discovery *LinkFilter
+	// infoLabels maps the keys of dynamicInterfaceInfo to the metric labels.
+	infoLabels []InfoLabel
+	// flowLimits bounds the number of the flow series.
+	flowLimits FlowLimits
+	// podDirection flips the directions of the node side peers of the pod interfaces, see WithPodDirection.
+	podDirection bool
+	// showPorts enables the port mode, see WithPorts.
+	showPorts bool
+	// portLabels maps the ports of the flow ends to the port labels.
+	portLabels PortLabels
+	// zones classifies the flow ends into the src_zone and dst_zone labels, nil means iftop.DefaultZones.
+	zones *iftop.Zones
+	// peers resolves the dst of the flows to the peer_owner and peer_kind labels, nil means disabled, see WithPeers.
+	peers *peerIndex
+
+	// watching is true while the watcher of the dynamic dir is running, watchErr is the error it exited with.
+	watching bool
+	watchErr error
+	// startedAt is when Run is called.
+	startedAt time.Time
+	// resyncInterval is how often the dynamic dir is scanned, 0 means only at start.
+	resyncInterval time.Duration
+	// readyMinFreshRatio is the min ratio of the fresh tasks for the Manager to be ready.
+	readyMinFreshRatio float64
+
+	// done is closed by Shutdown, wg tracks the exec loops and the watcher.
+	done     chan struct{}
+	doneOnce sync.Once
+	wg       sync.WaitGroup
 
 	// continuous determines the execution mode of iftop tasks.
 	//
@@ -46,19 +108,56 @@ type Manager struct {
 	// duration specifies the duration of each iftop run
 	duration time.Duration
 
+	// recorder records the raw outputs of each iftop run if not nil.
+	recorder *recorder.Recorder
+
+	// counters accumulates the bytes of each round into the monotonic counters.
+	counters *byteCounters
+	// progress accumulates the rounds and the unmatched lines of each run into the self metrics.
+	progress *runProgress
+
+	// backoffMax caps the delay before restarting a failed task.
+	backoffMax time.Duration
+	// parkAfter is the number of the consecutive failures to park a task, 0 means never.
+	parkAfter int
+
+	// staleAfter is how long the metrics of an interface are exported after its latest round,
+	// zero means it is derived from interval and duration, see staleness().
+	staleAfter time.Duration
+
 	debug bool
 }
 
 func NewManager(staticIntefaceNames []string, dynamic bool, dynamicDir string) (*Manager, error) {
 	manager := &Manager{
-		tasks:     make(map[string]*iftop.Task),
-		removeChs: make(map[string]chan int),
+		tasks:      make(map[string]FlowSource),
+		removeChs:  make(map[string]chan int),
+		running:    make(map[string]FlowSource),
+		taskStates: make(map[string]string),
+		resumeChs:  make(map[string]chan struct{}),
+		runStarts:  make(map[string]time.Time),
+		discovered: make(map[string]bool),
+		links:      make(map[string]bool),
+		scheduler:  newScheduler(0),
 
 		staticInterfaceNames: staticIntefaceNames,
 		dynamic:              dynamic,
 		dynamicDir:           dynamicDir,
 		dynamicInterfaceInfo: make(map[string]map[string]string),
+		captureOverrides:     make(map[string]*CaptureOptions),
+		restarting:           make(map[string]bool),
+		infoLabels:           []InfoLabel{{Key: "owner", Label: "owner"}},
+		counters:             newByteCounters(),
+		progress:             newRunProgress(),
+		readyMinFreshRatio:   DefaultReadyMinFreshRatio,
+		resyncInterval:       DefaultResyncInterval,
+		done:                 make(chan struct{}),
+		podDirection:         true,
+		portLabels:           PortLabels{EphemeralMin: DefaultEphemeralPortMin},
+		backoffMax:           DefaultBackoffMax,
+		parkAfter:            DefaultParkAfter,
 	}
+	manager.newSource = manager.newIftopTask
 
 	return manager, nil
 }
@@ -67,6 +166,88 @@ func (mgr *Manager) WithContinuous(continuous bool, interval time.Duration, dura
 	mgr.continuous = continuous
 	mgr.interval = interval
 	mgr.duration = duration
+
+	// the expected duty cycle, until the real one is measured from the runs
+	mgr.counters.defaultCoverage = 1
+	if !continuous && duration > 0 {
+		mgr.counters.defaultCoverage = duration.Seconds() / (duration + interval).Seconds()
+	}
+	return mgr
+}
+
+// WithFlowSourceFactory replaces the default iftop backend with the specified one.
+func (mgr *Manager) WithFlowSourceFactory(factory FlowSourceFactory) *Manager {
+	if factory != nil {
+		mgr.newSource = factory
+	}
+	return mgr
+}
+
+// WithBackend selects the builtin capture backend by name, see Backend* constants.
+func (mgr *Manager) WithBackend(backend string) error {
+	switch backend {
+	case BackendIftop:
+		mgr.newSource = mgr.newIftopTask
+	case BackendAFPacket:
+		mgr.newSource = mgr.newAFPacketSource
+	default:
+		return fmt.Errorf("unknown backend (%s), valid backends are: %s, %s", backend, BackendIftop, BackendAFPacket)
+	}
+	return nil
+}
+
+// WithReplay replaces the capture backend with the replay of the recorded iftop outputs under dir,
+// see iftop.Replay for the layout of dir and the meaning of speed.
+func (mgr *Manager) WithReplay(dir string, speed float64) *Manager {
+	mgr.newSource = func(interfaceName string) FlowSource {
+		return iftop.NewReplay(mgr.captureOptions(interfaceName), dir, speed)
+	}
+	return mgr
+}
+
+// WithRecorder records the raw outputs of each iftop run, it only applies to the iftop backend.
+func (mgr *Manager) WithRecorder(recorder *recorder.Recorder) *Manager {
+	mgr.recorder = recorder
+	return mgr
+}
+
+// WithFlowCounters enables the per flow byte counters, the per zone pair ("all" flows) counters are always enabled.
+func (mgr *Manager) WithFlowCounters(flowCounters bool) *Manager {
+	mgr.counters.flowCounters = flowCounters
+	return mgr
+}
+
+// WithStaleAfter sets how long the metrics of an interface are exported after its latest round,
+// zero means three times of the run interval (at least 30 seconds), negative means never.
+func (mgr *Manager) WithStaleAfter(staleAfter time.Duration) *Manager {
+	mgr.staleAfter = staleAfter
+	return mgr
+}
+
+// WithInfoLabels sets which keys of the dynamic interface info are exported as the metric labels,
+// see ParseInfoLabels.
+func (mgr *Manager) WithInfoLabels(infoLabels []InfoLabel) *Manager {
+	mgr.infoLabels = infoLabels
+	return mgr
+}
+
+// WithFlowLimits bounds the number of the flow series, see FlowLimits.
+// The TopK also bounds the number of the per flow counters of each interface.
+func (mgr *Manager) WithFlowLimits(flowLimits FlowLimits) error {
+	if err := flowLimits.Valid(); err != nil {
+		return err
+	}
+	mgr.flowLimits = flowLimits
+	mgr.counters.maxFlowTotals = flowLimits.TopK
+	return nil
+}
+
+// WithZones sets the zones of the flow ends, see iftop.ParseZones.
+func (mgr *Manager) WithZones(zones *iftop.Zones) *Manager {
+	mgr.zones = zones
+	if mgr.peers != nil {
+		mgr.peers.defaultZone = zones.DefaultZone()
+	}
 	return mgr
 }
 
@@ -109,9 +290,36 @@ func (mgr *Manager) watch() error {
 		return fmt.Errorf("create watching file (%s) failed, err: %s", watchingFile, err)
 	}
 	log.Printf("create watching file (%s) succeeded", watchingFile)
+	mgr.setWatchStatus(true, nil)
+
+	// the helper must not trust the watching file left by an exited watcher
+	defer func() {
+		if err := os.Remove(watchingFile); err != nil && !os.IsNotExist(err) {
+			log.Printf("remove watching file (%s) failed, err: %s", watchingFile, err)
+		} else {
+			log.Printf("remove watching file (%s) succeeded", watchingFile)
+		}
+	}()
+
+	// the files written before the watcher started are only seen by the scan,
+	// the periodic scans also catch up with the missed events
+	mgr.resync()
+	var resyncC <-chan time.Time
+	if mgr.resyncInterval > 0 {
+		ticker := time.NewTicker(mgr.resyncInterval)
+		defer ticker.Stop()
+		resyncC = ticker.C
+	}
 
 	for {
 		select {
+		case <-mgr.done:
+			log.Println("watch stopped")
+			return nil
+
+		case <-resyncC:
+			mgr.resync()
+
 		case event, ok := <-watcher.Events:
 			if !ok {
 				log.Println("not ok")
@@ -122,8 +330,13 @@ func (mgr *Manager) watch() error {
 			interfaceName := filepath.Base(event.Name)
 			log.Println("watch got file name:", interfaceName)
 
-			if interfaceName == ".watching" {
-				log.Printf("watch ignored watching file")
+			if interfaceName == PeerIndexFile {
+				mgr.loadPeers()
+				continue
+			}
+
+			if isHiddenFile(interfaceName) {
+				log.Printf("watch ignored hidden file (%s)", interfaceName)
 				continue
 			}
 
@@ -135,40 +348,31 @@ func (mgr *Manager) watch() error {
 			log.Printf("check event operation for interface (%s)", interfaceName)
 			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Chmod) {
 				log.Printf("[event (%s)] try to call LinkByName for interface (%s)", event.Op, interfaceName)
-				_, err := netlink.LinkByName(interfaceName)
+				exists, err := linkExists(interfaceName)
 				if err != nil {
-					if _, ok := err.(netlink.LinkNotFoundError); ok {
-						log.Printf("interface ignored, not found link for interface (%s)", interfaceName)
-					} else {
-						log.Printf("call LinkByName failed, err: %s", err)
-					}
+					log.Printf("call LinkByName failed, err: %s", err)
 					continue
 				}
-
-				interfaceInfo := map[string]string{}
-
-				b, err := os.ReadFile(event.Name)
-				if err != nil {
-					log.Printf("read file failed for interface (%s), err: %s", interfaceName, err)
+				if !exists {
+					log.Printf("interface ignored, not found link for interface (%s)", interfaceName)
 					continue
 				}
 
-				if err := json.Unmarshal(b, &interfaceInfo); err != nil {
-					log.Printf("json unmarshal failed for interface (%s), err: %s", interfaceName, err)
+				if err := mgr.addDynamic(interfaceName, event.Name); err != nil {
+					log.Printf("add dynamic interface (%s) failed, err: %s", interfaceName, err)
 					continue
 				}
-
-				mgr.lock.Lock()
-				mgr.dynamicInterfaceInfo[interfaceName] = interfaceInfo
-				mgr.lock.Unlock()
-
-				owner := interfaceInfo["owner"]
-				log.Printf("try to start iftop for interface (%s, %s)", interfaceName, owner)
-				mgr.start(interfaceName)
+				// the changed file is a chance for the parked task
+				mgr.resume(interfaceName)
 				continue
 			}
 
-			if event.Has(fsnotify.Remove) {
+			// Rename means the file is moved away, an atomic write renames a hidden temp file over it, which is a Create
+			if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+				if _, err := os.Stat(event.Name); err == nil {
+					log.Printf("[event (%s)] file of interface (%s) still exists, ignored", event.Op, interfaceName)
+					continue
+				}
 				log.Printf("[event (%s)] try to stop iftop task for interface (%s)", event.Op, interfaceName)
 				mgr.stop(interfaceName)
 				continue
@@ -183,6 +387,16 @@ func (mgr *Manager) watch() error {
 	}
 }
 
+// isShuttingDown returns true after Shutdown is called.
+func (mgr *Manager) isShuttingDown() bool {
+	select {
+	case <-mgr.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (mgr *Manager) static() error {
 	for _, interfaceName := range mgr.staticInterfaceNames {
 		go mgr.exec(interfaceName)
@@ -200,30 +414,54 @@ func (mgr *Manager) stop(interfaceName string) {
 	defer mgr.lock.Unlock()
 
 	if removeCh, ok := mgr.removeChs[interfaceName]; ok {
-		close(removeCh)
+		select {
+		case <-removeCh:
+			// already stopped, e.g. by both the dynamic file and the link deletion
+		default:
+			close(removeCh)
+		}
 	}
 }
 
 func (mgr *Manager) exec(interfaceName string) error {
+	// built before taking the lock, the factory reads the capture options under the lock
+	iftopTask := mgr.newSource(interfaceName)
+
 	// To avoid starting multiple iftop tasks for the same interface
 	mgr.lock.Lock()
+	if mgr.isShuttingDown() {
+		log.Printf("manager is shutting down, no need to start iftop task (%s)", interfaceName)
+		mgr.lock.Unlock()
+		return nil
+	}
 	_, exists := mgr.tasks[interfaceName]
 	if exists {
 		log.Printf("iftop task already there (%s)", interfaceName)
 		mgr.lock.Unlock()
 		return nil
 	}
+	// added under the lock, so it never races with the Wait of Shutdown
+	mgr.wg.Add(1)
+	defer mgr.wg.Done()
 
-	iftopTask := mgr.newIftopTask(interfaceName)
 	removeCh := make(chan int)
 	exitCh := make(chan error)
+	// ctx is cancelled when the interface is removed, it kills the run in progress
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	mgr.tasks[interfaceName] = iftopTask
 	mgr.removeChs[interfaceName] = removeCh
+	activeTasks.Set(float64(len(mgr.tasks)))
 	mgr.lock.Unlock()
 
 	go func() {
+		select {
+		case <-time.After(mgr.startOffset(interfaceName)):
+		case <-ctx.Done():
+		}
+
 		mgr.Debugf("initial iftop task start (%s)", interfaceName)
-		err := iftopTask.Run()
+		err := mgr.runSource(ctx, interfaceName, iftopTask)
 		if err != nil {
 			mgr.Debugf("initial iftop task exit (%s), err: %s", interfaceName, err)
 		} else {
@@ -232,23 +470,44 @@ func (mgr *Manager) exec(interfaceName string) error {
 		exitCh <- err
 	}()
 
+	// failures is the number of the consecutive failed runs
+	failures := 0
 	for {
 		select {
 
 		case exitErr := <-exitCh:
-			sleepSeconds := int(mgr.interval.Seconds())
-
-			if exitErr != nil {
-				log.Printf("iftop task exit (%s) with error (%s), wait several seconds and start again", interfaceName, exitErr)
+			// the interval below one second means no sleep between runs
+			delay := mgr.interval.Truncate(time.Second)
+
+			if exitErr != nil && !errors.Is(exitErr, context.Canceled) {
+				failures++
+				// the same filter fails again, until it is changed in the dynamic file
+				badFilter := errors.Is(exitErr, iftop.ErrBadFilter)
+
+				if mgr.parkAfter > 0 && (failures >= mgr.parkAfter || badFilter) {
+					log.Printf("iftop task exit (%s) with error (%s), failed (%d) times in a row, park it until its dynamic file changes or its link reappears", interfaceName, exitErr, failures)
+					if !mgr.park(interfaceName, removeCh) {
+						// removed or shutting down, wait for the remove signal
+						continue
+					}
+					failures = 0
+					delay = 0
+				} else {
+					delay = mgr.backoff(failures)
+					log.Printf("iftop task exit (%s) with error (%s), failed (%d) times in a row, start again after (%s)", interfaceName, exitErr, failures, delay)
+					mgr.setTaskState(interfaceName, TaskStateBackingOff)
+				}
+			} else {
+				failures = 0
 			}
 
-			if err := mgr.startTask(interfaceName, removeCh, exitCh, sleepSeconds); err != nil {
+			if err := mgr.startTask(ctx, interfaceName, removeCh, exitCh, delay); err != nil {
 				log.Printf("start task failed, err: %s", err)
 			}
 
 		case <-removeCh:
 			log.Printf("exec got remove signal for interface (%s)", interfaceName)
-			if err := mgr.removeTask(interfaceName); err != nil {
+			if err := mgr.removeTask(interfaceName, cancel); err != nil {
 				log.Printf("remove task failed, err: %s", err)
 			}
 
@@ -258,31 +517,31 @@ func (mgr *Manager) exec(interfaceName string) error {
 	}
 }
 
-// startTask waits for specified sleepSeconds and start iftop task for specified interface.
-func (mgr *Manager) startTask(interfaceName string, removeCh <-chan int, exitCh chan<- error, sleepSeconds int) error {
+// startTask waits for specified delay and start iftop task for specified interface.
+func (mgr *Manager) startTask(ctx context.Context, interfaceName string, removeCh <-chan int, exitCh chan<- error, delay time.Duration) error {
 	select {
-	case <-time.After(time.Duration(sleepSeconds) * time.Second):
+	case <-time.After(delay):
 		go func() {
-			iftopTask := mgr.newIftopTask(interfaceName)
+			iftopTask := mgr.newSource(interfaceName)
 
 			if mgr.continuous {
 				// In continuous mode, we must update the cached iftop task BEFORE running it.
 				// This is because the iftop task blocks during execution, and if we don't update
-				// the cache first, the updateMetricsLoop would continue using the old task's
+				// the cache first, the collector would continue using the old task's
 				// metrics until the new task completes.
-				mgr.lock.Lock()
-				mgr.tasks[interfaceName] = iftopTask
-				mgr.lock.Unlock()
+				if !mgr.setTask(interfaceName, iftopTask, removeCh) {
+					exitCh <- nil
+					return
+				}
 			}
 
 			mgr.Debugf("iftop task start (%s)", interfaceName)
-			err := iftopTask.Run()
+			restarts.WithLabelValues(interfaceName).Inc()
+			err := mgr.runSource(ctx, interfaceName, iftopTask)
 
 			if !mgr.continuous {
 				// In periodic mode, update the cached iftop task AFTER iftop task exit
-				mgr.lock.Lock()
-				mgr.tasks[interfaceName] = iftopTask
-				mgr.lock.Unlock()
+				mgr.setTask(interfaceName, iftopTask, removeCh)
 			}
 
 			if err != nil {
@@ -296,72 +555,335 @@ func (mgr *Manager) startTask(interfaceName string, removeCh <-chan int, exitCh
 	case <-removeCh:
 		log.Printf("start task got remove signal for interface (%s), no need to start", interfaceName)
 		return nil
+
+	case <-mgr.done:
+		log.Printf("start task got shutdown signal for interface (%s), no need to start", interfaceName)
+		return nil
 	}
 }
 
-func (mgr *Manager) removeTask(interfaceName string) error {
-	iftopTask, ok := mgr.tasks[interfaceName]
-	if !ok {
-		return nil
+// setTask caches the source of the interface, unless the interface has been removed
+// (or removed and added again) after the removeCh was created, or the Manager is shutting down.
+// It reports whether the source is cached.
+func (mgr *Manager) setTask(interfaceName string, source FlowSource, removeCh <-chan int) bool {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	if mgr.isShuttingDown() {
+		return false
+	}
+	if current, ok := mgr.removeChs[interfaceName]; !ok || current != removeCh {
+		return false
 	}
+	mgr.tasks[interfaceName] = source
+	return true
+}
 
-	log.Printf("remove task, try to kill iftop for interface (%s)", interfaceName)
+// runSource runs the source until it exits or ctx is done, and updates the metrics of the run.
+// The metrics are not updated if the interface has been removed in the meantime.
+func (mgr *Manager) runSource(ctx context.Context, interfaceName string, source FlowSource) error {
+	if ctx.Err() != nil {
+		return nil
+	}
 
-	if iftopTask.GetCmd() != nil && iftopTask.GetCmd().Process != nil {
-		if err := iftopTask.GetCmd().Process.Kill(); err != nil {
-			log.Printf("kill process for interface (%s) failed, err: %s", interfaceName, err)
-		} else {
-			log.Printf("kill process for interface (%s) succeeded", interfaceName)
+	mgr.lock.Lock()
+	mgr.running[interfaceName] = source
+	mgr.lock.Unlock()
+	defer func() {
+		mgr.lock.Lock()
+		if mgr.running[interfaceName] == source {
+			delete(mgr.running, interfaceName)
 		}
+		mgr.lock.Unlock()
+	}()
+
+	if mgr.scheduler.maxConcurrent > 0 {
+		mgr.setTaskState(interfaceName, TaskStateWaiting)
 	}
+	if err := mgr.scheduler.acquire(ctx); err != nil {
+		return nil
+	}
+	defer mgr.scheduler.release()
+
+	mgr.setTaskState(interfaceName, TaskStateRunning)
+	runsStarted.WithLabelValues(interfaceName).Inc()
+	start := time.Now()
+	mgr.observeRunStart(interfaceName, start)
+
+	err := source.RunContext(ctx)
+	if ctx.Err() != nil {
+		return err
+	}
+	if mgr.takeRestart(interfaceName) {
+		// stopped to apply the changed capture options, not a failure
+		mgr.accumulate(interfaceName, source.State())
+		return nil
+	}
+
+	observeRun(interfaceName, time.Since(start), err)
+	// accumulate the last round, it may be missed by the accumulateLoop
+	mgr.accumulate(interfaceName, source.State())
+	return err
+}
+
+// removeTask kills the run in progress of the interface by cancel, and drops its task and metrics.
+func (mgr *Manager) removeTask(interfaceName string, cancel context.CancelFunc) error {
+	log.Printf("remove task, try to kill iftop for interface (%s)", interfaceName)
+	cancel()
+
+	mgr.counters.forget(interfaceName)
+	mgr.progress.forget(interfaceName)
+	deleteSelfMetrics(interfaceName)
 
 	mgr.lock.Lock()
 	delete(mgr.removeChs, interfaceName)
 	delete(mgr.tasks, interfaceName)
+	delete(mgr.taskStates, interfaceName)
+	delete(mgr.resumeChs, interfaceName)
+	delete(mgr.runStarts, interfaceName)
 	delete(mgr.dynamicInterfaceInfo, interfaceName)
+	delete(mgr.captureOverrides, interfaceName)
+	delete(mgr.restarting, interfaceName)
+	delete(mgr.discovered, interfaceName)
+	activeTasks.Set(float64(len(mgr.tasks)))
 	mgr.lock.Unlock()
 	return nil
 }
 
-func (mgr *Manager) updateMetricsLoop() error {
+// accumulateLoop keeps the counters up to date with the rounds of the tasks,
+// the rounds are also accumulated at scrape time, this loop covers the rounds between scrapes.
+func (mgr *Manager) accumulateLoop() error {
 	ticker := time.NewTicker(time.Second * 10)
 	defer ticker.Stop()
 	for {
 		select {
+		case <-mgr.done:
+			return nil
+
 		case <-ticker.C:
-			mgr.Debugf("update metrics: found total (%d) iftop tasks", len(mgr.tasks))
-			states := []iftop.State{}
-			for _, iftopTask := range mgr.tasks {
-				states = append(states, iftopTask.State())
+			sources := mgr.sources()
+			mgr.Debugf("accumulate counters: found total (%d) iftop tasks", len(sources))
+
+			// State() is called out of the lock, the sources publish their snapshots atomically.
+			for _, source := range sources {
+				mgr.accumulate(source.ID(), source.State())
 			}
-			mgr.updateMetrics(states)
 		}
 	}
 }
 
+// staleness returns how long the metrics of an interface are exported after its latest round,
+// zero means the metrics never go stale.
+func (mgr *Manager) staleness() time.Duration {
+	if mgr.staleAfter < 0 {
+		return 0
+	}
+	if mgr.staleAfter > 0 {
+		return mgr.staleAfter
+	}
+	return mgr.defaultStaleness()
+}
+
+// defaultStaleness returns the staleness derived from interval and duration.
+func (mgr *Manager) defaultStaleness() time.Duration {
+	// a healthy interface completes a round at least once per interval+duration
+	return max(3*(mgr.interval+mgr.duration), 30*time.Second)
+}
+
+// sources returns the current sources of all tasks.
+func (mgr *Manager) sources() []FlowSource {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	sources := make([]FlowSource, 0, len(mgr.tasks))
+	for _, iftopTask := range mgr.tasks {
+		sources = append(sources, iftopTask)
+	}
+	return sources
+}
+
+// states returns the latest snapshots of all tasks.
+func (mgr *Manager) states() []iftop.State {
+	// State() is called out of the lock, the sources publish their snapshots atomically.
+	sources := mgr.sources()
+	states := make([]iftop.State, 0, len(sources))
+	for _, source := range sources {
+		states = append(states, source.State())
+	}
+	return states
+}
+
+// interfaceInfo returns the dynamic interface info of the interface, nil for static interfaces.
+func (mgr *Manager) interfaceInfo(interfaceName string) map[string]string {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+	return mgr.dynamicInterfaceInfo[interfaceName]
+}
+
 func (mgr *Manager) Run() error {
+	mgr.lock.Lock()
+	mgr.startedAt = time.Now()
+	mgr.lock.Unlock()
+
 	log.Println("start: static interfaces")
 	mgr.static()
-	go mgr.watch()
+
+	if mgr.parkAfter > 0 || mgr.discovery != nil {
+		go mgr.watchLinks()
+	}
+
+	mgr.wg.Add(1)
+	go func() {
+		defer mgr.wg.Done()
+
+		err := mgr.watch()
+		if !mgr.dynamic || mgr.isShuttingDown() {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("watcher exited")
+		}
+		log.Printf("watch dynamic dir failed, err: %s", err)
+		mgr.setWatchStatus(false, err)
+	}()
 
 	// block here
-	if err := mgr.updateMetricsLoop(); err != nil {
-		return fmt.Errorf("manager update metrics loop failed, err: %s", err)
+	if err := mgr.accumulateLoop(); err != nil {
+		return fmt.Errorf("manager accumulate loop failed, err: %s", err)
 	}
 
 	return nil
 }
 
-func (mgr *Manager) newIftopTask(interfaceName string) *iftop.Task {
+// terminator is implemented by the sources which can be stopped gracefully, see iftop.Task.
+type terminator interface {
+	Terminate(timeout time.Duration) error
+}
+
+// Shutdown stops the watcher and all tasks, and waits for them to exit.
+// The sources are terminated gracefully if they support it (e.g. SIGTERM to iftop, then SIGKILL after timeout),
+// otherwise they are stopped at once. It returns an error if they do not exit within timeout after that.
+func (mgr *Manager) Shutdown(timeout time.Duration) error {
+	mgr.lock.Lock()
+	mgr.doneOnce.Do(func() {
+		close(mgr.done)
+	})
+	mgr.lock.Unlock()
+
+	// the running sources are terminated, in periodic mode the cached ones have exited already
+	mgr.lock.Lock()
+	sources := make([]FlowSource, 0, len(mgr.running))
+	for _, source := range mgr.running {
+		sources = append(sources, source)
+	}
+	mgr.lock.Unlock()
+	log.Printf("shutdown: terminate (%d) iftop tasks", len(sources))
+
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var err error
+			if t, ok := source.(terminator); ok {
+				err = t.Terminate(timeout)
+			} else {
+				err = source.Stop()
+			}
+			if err != nil {
+				log.Printf("shutdown: terminate iftop task (%s) failed, err: %s", source.ID(), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	mgr.lock.Lock()
+	interfaceNames := make([]string, 0, len(mgr.removeChs))
+	for interfaceName := range mgr.removeChs {
+		interfaceNames = append(interfaceNames, interfaceName)
+	}
+	mgr.lock.Unlock()
+	for _, interfaceName := range interfaceNames {
+		mgr.stop(interfaceName)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		mgr.wg.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+		log.Println("shutdown: all iftop tasks exited")
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("shutdown: iftop tasks did not exit within (%s)", timeout)
+	}
+}
+
+// captureOptions returns the options of each capture run for the specified interface.
+func (mgr *Manager) captureOptions(interfaceName string) iftop.Options {
 	options := iftop.Options{
 		InterfaceName:    interfaceName,
 		NoHostnameLookup: true,
 		SortBy:           iftop.SortBy2s,
+		Zones:            mgr.zones,
+	}
+
+	if mgr.showPorts {
+		options.ShowPort = true
+		options.NoPortConvert = true
 	}
 
 	if !mgr.continuous {
 		options.SingleSeconds = int(mgr.duration.Seconds())
 	}
 
-	return iftop.NewTask(options)
+	if mgr.captureDefaults != nil {
+		mgr.captureDefaults.apply(&options, mgr.continuous)
+	}
+
+	mgr.lock.Lock()
+	capture := mgr.captureOverrides[interfaceName]
+	mgr.lock.Unlock()
+	if capture != nil {
+		capture.apply(&options, mgr.continuous)
+	}
+
+	return options
+}
+
+// hangTimeout returns how long an iftop run with the options may produce no output before it is killed.
+func (mgr *Manager) hangTimeout(options iftop.Options) time.Duration {
+	if options.SingleSeconds == 0 {
+		// the text mode prints the flows every 2 seconds
+		return 2*time.Second + hangGracePeriod
+	}
+	// iftop -s prints the flows only once, after the duration
+	return time.Duration(options.SingleSeconds)*time.Second + hangGracePeriod
+}
+
+func (mgr *Manager) newIftopTask(interfaceName string) FlowSource {
+	options := mgr.captureOptions(interfaceName)
+	task := iftop.NewTask(options)
+	task.WithHangTimeout(mgr.hangTimeout(options))
+
+	if mgr.recorder != nil {
+		task.WithRecorder(func() (iftop.OutputRecorder, error) {
+			run, err := mgr.recorder.NewRun(interfaceName)
+			if err != nil {
+				log.Printf("create record for interface (%s) failed, err: %s", interfaceName, err)
+				return nil, err
+			}
+			return run, nil
+		})
+	}
+
+	return task
+}
+
+func (mgr *Manager) newAFPacketSource(interfaceName string) FlowSource {
+	return afpacket.NewSource(mgr.captureOptions(interfaceName))
 }
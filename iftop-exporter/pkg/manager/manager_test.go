@@ -0,0 +1,270 @@
+package manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSource is a FlowSource which "captures" until it is stopped or runFor elapsed.
+type fakeSource struct {
+	id     string
+	runFor time.Duration
+	err    error
+	state  iftop.State
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+func newFakeSource(id string, runFor time.Duration) *fakeSource {
+	return &fakeSource{
+		id:     id,
+		runFor: runFor,
+		state: iftop.State{
+			Interface: id,
+			FlowStats: &iftop.FlowStats{},
+		},
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (s *fakeSource) ID() string {
+	return s.id
+}
+
+func (s *fakeSource) RunContext(ctx context.Context) error {
+	select {
+	case <-time.After(s.runFor):
+	case <-s.stopCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.err
+}
+
+func (s *fakeSource) Stop() error {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	return nil
+}
+
+func (s *fakeSource) State() iftop.State {
+	return s.state
+}
+
+// fakeFactory records every source created by the Manager.
+type fakeFactory struct {
+	lock    sync.Mutex
+	runFor  time.Duration
+	err     error // returned by the runs of the created sources
+	sources []*fakeSource
+}
+
+func (f *fakeFactory) newSource(interfaceName string) FlowSource {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	s := newFakeSource(interfaceName, f.runFor)
+	s.err = f.err
+	f.sources = append(f.sources, s)
+	return s
+}
+
+func (f *fakeFactory) created() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.sources)
+}
+
+func TestManagerWithFlowSourceFactory(t *testing.T) {
+	factory := &fakeFactory{runFor: 10 * time.Millisecond}
+
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	// interval below one second means no sleep between runs
+	mgr.WithContinuous(false, 100*time.Millisecond, 10*time.Millisecond)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	done := make(chan struct{})
+	go func() {
+		mgr.exec("eth0")
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return factory.created() >= 3
+	}, 5*time.Second, 10*time.Millisecond, "the source should be restarted after each run")
+
+	mgr.stop("eth0")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exec did not return after stop")
+	}
+
+	mgr.lock.Lock()
+	_, exists := mgr.tasks["eth0"]
+	mgr.lock.Unlock()
+	assert.False(t, exists, "the task should be removed after stop")
+}
+
+// TestManagerRemoveRunning removes an interface while its run is in progress,
+// in periodic mode the running source is not cached yet, it must be cancelled anyway.
+func TestManagerRemoveRunning(t *testing.T) {
+	factory := &fakeFactory{runFor: 10 * time.Millisecond}
+
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(false, 100*time.Millisecond, 10*time.Millisecond)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	done := make(chan struct{})
+	go func() {
+		mgr.exec("eth0")
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return factory.created() >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	// the following runs block until they are cancelled
+	factory.lock.Lock()
+	factory.runFor = time.Hour
+	factory.lock.Unlock()
+
+	var running FlowSource
+	assert.Eventually(t, func() bool {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		running = mgr.running["eth0"]
+		return running != nil && running.(*fakeSource).runFor == time.Hour
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mgr.stop("eth0")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exec did not return after stop")
+	}
+
+	assert.Eventually(t, func() bool {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		return len(mgr.running) == 0
+	}, 5*time.Second, 10*time.Millisecond, "the running source should be cancelled")
+
+	// the cancelled run must not cache its source after the interface is removed
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, mgr.sources())
+}
+
+// TestManagerStates reads the states while the tasks are being restarted and removed,
+// it is meant to be run with `go test -race`.
+func TestManagerStates(t *testing.T) {
+	factory := &fakeFactory{runFor: time.Millisecond}
+
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 100*time.Millisecond, 0)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"eth0", "eth1", "eth2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mgr.exec(name)
+		}()
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(mgr.Collector())
+
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		_, err := registry.Gather()
+		assert.NoError(t, err)
+	}
+
+	for _, name := range []string{"eth0", "eth1", "eth2"} {
+		mgr.stop(name)
+	}
+	wg.Wait()
+
+	assert.Empty(t, mgr.states())
+}
+
+func TestManagerShutdown(t *testing.T) {
+	factory := &fakeFactory{runFor: time.Hour}
+	dynamicDir := t.TempDir()
+	watchingFile := filepath.Join(dynamicDir, ".watching")
+
+	mgr, err := NewManager([]string{"eth0", "eth1"}, true, dynamicDir)
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 100*time.Millisecond, 0)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- mgr.Run()
+	}()
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(watchingFile)
+		return err == nil && len(mgr.sources()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, mgr.Shutdown(5*time.Second))
+
+	assert.Empty(t, mgr.sources())
+	_, err = os.Stat(watchingFile)
+	assert.True(t, os.IsNotExist(err), "the watching file should be removed")
+
+	select {
+	case err := <-runErrCh:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Shutdown")
+	}
+
+	// no task is started after shutdown
+	assert.NoError(t, mgr.exec("eth2"))
+	assert.Empty(t, mgr.sources())
+	assert.Empty(t, mgr.Health().Watcher.Error, "shutdown is not a watcher failure")
+
+	// in periodic mode, the run in flight is not cached in tasks yet, it must be terminated anyway
+	factory = &fakeFactory{runFor: time.Hour}
+	mgr, err = NewManager([]string{"eth0"}, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(false, 100*time.Millisecond, 10*time.Millisecond)
+	mgr.WithFlowSourceFactory(factory.newSource)
+
+	go mgr.Run()
+
+	var running *fakeSource
+	assert.Eventually(t, func() bool {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		source, ok := mgr.running["eth0"]
+		if ok {
+			running = source.(*fakeSource)
+		}
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, mgr.Shutdown(5*time.Second))
+	select {
+	case <-running.stopCh:
+	default:
+		t.Fatal("the run in flight was not terminated")
+	}
+}
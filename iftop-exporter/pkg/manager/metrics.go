@@ -1,125 +1,344 @@
 package manager
 
 import (
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
-	flowLast2 = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "iftop_flow_last2_speed_bps",
-		Help: "data transfer rate (bits per second) of the flow over the preceding 2 seconds",
-	}, []string{"interface", "src", "dst", "direction", "type", "owner"})
-
-	flowLast10 = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "iftop_flow_last10_speed_bps",
-		Help: "data transfer rate (bits per second) of the flow over the preceding 10 seconds",
-	}, []string{"interface", "src", "dst", "direction", "type", "owner"})
-
-	flowLast40 = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "iftop_flow_last40_speed_bps",
-		Help: "data transfer rate (bits per second) of the flow over the preceding 40 seconds",
-	}, []string{"interface", "src", "dst", "direction", "type", "owner"})
-
-	flowCumulative = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "iftop_flow_cumulative_bytes",
-		Help: "cumulative bytes of the flow",
-	}, []string{"interface", "src", "dst", "direction", "type", "owner"})
-
-	totalLast2 = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "iftop_total_last2_speed_bps",
-		Help: "data transfer rate (bits per second) of all flows over the preceding 2 seconds",
-	}, []string{"interface", "direction", "owner"})
-
-	totalLast10 = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "iftop_total_last10_speed_bps",
-		Help: "data transfer rate (bits per second) of all flows over the preceding 10 seconds",
-	}, []string{"interface", "direction", "owner"})
-
-	totalLast40 = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "iftop_total_last40_speed_bps",
-		Help: "data transfer rate (bits per second) of all flows over the preceding 40 seconds",
-	}, []string{"interface", "direction", "owner"})
-
-	peak = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "iftop_peak_speed_bps",
-		Help: "the peak data transfer rate (bits per second) of all flows",
-	}, []string{"interface", "direction", "owner"})
-
-	cumulative = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "iftop_cumulative_bytes",
-		Help: "the cumulative bytes of all flows",
-	}, []string{"interface", "direction", "owner"})
+	flowLabels     = []string{"interface", "src", "dst", "direction", "src_zone", "dst_zone", "src_port", "dst_port", "peer_owner", "peer_kind"}
+	totalLabels    = []string{"interface", "direction"}
+	interfaceLabel = []string{"interface"}
 )
 
-// updateMetrics update metrics by reading the value from state
-func (mgr *Manager) updateMetrics(states []iftop.State) {
-	if len(states) == 0 {
-		return
+// metricDescs holds the descriptions of all metrics, the info labels are appended to the labels of each metric,
+// so all metric families have the same info labels.
+type metricDescs struct {
+	flowLast2           *prometheus.Desc
+	flowLast10          *prometheus.Desc
+	flowLast40          *prometheus.Desc
+	flowCumulative      *prometheus.Desc
+	totalLast2          *prometheus.Desc
+	totalLast10         *prometheus.Desc
+	totalLast40         *prometheus.Desc
+	peak                *prometheus.Desc
+	cumulative          *prometheus.Desc
+	estimatedCumulative *prometheus.Desc
+	samplingCoverage    *prometheus.Desc
+	lastUpdate          *prometheus.Desc
+	bytesTotal          *prometheus.Desc
+	estimatedBytesTotal *prometheus.Desc
+	flowBytesTotal      *prometheus.Desc
+	foldedFlows         *prometheus.Desc
+}
+
+func newMetricDescs(infoLabels []InfoLabel) *metricDescs {
+	newDesc := func(name string, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(name, help, slices.Concat(labels, infoLabelNames(infoLabels)), nil)
+	}
+
+	return &metricDescs{
+		flowLast2: newDesc(
+			"iftop_flow_last2_speed_bps",
+			"data transfer rate (bits per second) of the flow over the preceding 2 seconds",
+			flowLabels),
+
+		flowLast10: newDesc(
+			"iftop_flow_last10_speed_bps",
+			"data transfer rate (bits per second) of the flow over the preceding 10 seconds",
+			flowLabels),
+
+		flowLast40: newDesc(
+			"iftop_flow_last40_speed_bps",
+			"data transfer rate (bits per second) of the flow over the preceding 40 seconds",
+			flowLabels),
+
+		flowCumulative: newDesc(
+			"iftop_flow_cumulative_bytes",
+			"cumulative bytes of the flow",
+			flowLabels),
+
+		totalLast2: newDesc(
+			"iftop_total_last2_speed_bps",
+			"data transfer rate (bits per second) of all flows over the preceding 2 seconds",
+			totalLabels),
+
+		totalLast10: newDesc(
+			"iftop_total_last10_speed_bps",
+			"data transfer rate (bits per second) of all flows over the preceding 10 seconds",
+			totalLabels),
+
+		totalLast40: newDesc(
+			"iftop_total_last40_speed_bps",
+			"data transfer rate (bits per second) of all flows over the preceding 40 seconds",
+			totalLabels),
+
+		peak: newDesc(
+			"iftop_peak_speed_bps",
+			"the peak data transfer rate (bits per second) of all flows",
+			totalLabels),
+
+		cumulative: newDesc(
+			"iftop_cumulative_bytes",
+			"the cumulative bytes of all flows",
+			totalLabels),
+
+		estimatedCumulative: newDesc(
+			"iftop_estimated_cumulative_bytes",
+			"the cumulative bytes of all flows scaled by the sampling coverage, which estimates the bytes of the full run interval",
+			totalLabels),
+
+		samplingCoverage: newDesc(
+			"iftop_sampling_coverage_ratio",
+			"the ratio of the time observed by iftop runs to the wall time, 1 means no traffic is missed",
+			interfaceLabel),
+
+		lastUpdate: newDesc(
+			"iftop_last_update_timestamp_seconds",
+			"the unix timestamp when the latest round of the interface completed",
+			interfaceLabel),
+
+		bytesTotal: newDesc(
+			"iftop_bytes_total",
+			"total bytes of all flows observed by iftop runs, it survives iftop restarts, the traffic between runs is not observed",
+			totalLabels),
+
+		estimatedBytesTotal: newDesc(
+			"iftop_estimated_bytes_total",
+			"total bytes of all flows scaled by the sampling coverage, which estimates the traffic between runs",
+			totalLabels),
+
+		flowBytesTotal: newDesc(
+			"iftop_flow_bytes_total",
+			"total bytes of the flow observed by iftop runs, it survives iftop restarts, the traffic between runs is not observed",
+			flowLabels),
+
+		foldedFlows: newDesc(
+			"iftop_exporter_folded_flows",
+			"the number of the src/dst pairs folded into the src=\"other\",dst=\"other\" flows in the latest round, by the reason (top_k or max_series)",
+			[]string{"interface", "reason"}),
 	}
+}
+
+// all returns the descriptions of all metrics.
+func (d *metricDescs) all() []*prometheus.Desc {
+	return []*prometheus.Desc{
+		d.flowLast2, d.flowLast10, d.flowLast40, d.flowCumulative,
+		d.totalLast2, d.totalLast10, d.totalLast40, d.peak, d.cumulative,
+		d.estimatedCumulative, d.samplingCoverage, d.lastUpdate,
+		d.bytesTotal, d.estimatedBytesTotal, d.flowBytesTotal,
+		d.foldedFlows,
+	}
+}
 
-	flowLast2.Reset()
-	flowLast10.Reset()
-	flowLast40.Reset()
-	flowCumulative.Reset()
-	totalLast2.Reset()
-	totalLast10.Reset()
-	totalLast40.Reset()
-	peak.Reset()
-	cumulative.Reset()
+// Collector builds the metrics from the latest snapshots of the tasks at scrape time,
+// so a scrape always sees a complete metric set, and the interfaces whose latest round
+// is older than the staleness bound of the Manager are dropped.
+type Collector struct {
+	mgr   *Manager
+	descs *metricDescs
+}
+
+// Collector returns the prometheus collector of the metrics of the Manager,
+// it must be called after the info labels are set, see WithInfoLabels.
+func (mgr *Manager) Collector() *Collector {
+	return &Collector{
+		mgr:   mgr,
+		descs: newMetricDescs(mgr.infoLabels),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs.all() {
+		ch <- desc
+	}
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	mgr := c.mgr
+	now := time.Now()
+
+	states := map[string]iftop.State{}
+	samples := map[string][]*flowSample{}
+	for _, source := range mgr.sources() {
+		interfaceName := source.ID()
+		state := source.State()
+
+		// make the counters up to date with the snapshot
+		mgr.accumulate(interfaceName, state)
 
-	for _, state := range states {
 		if state.FlowStats == nil {
 			continue
 		}
 
-		interfaceName := state.Interface
-		out := string(iftop.FlowDirectionOut)
-		in := string(iftop.FlowDirectionIn)
-		x := string(iftop.FlowDirectionX)
-		interfaceInfo := mgr.dynamicInterfaceInfo[interfaceName]
-		owner := interfaceInfo["owner"]
-
-		mgr.Debugf("update metrics: (%d) flows for interface (%s, %s)", len(state.FlowStats.Flows), interfaceName, owner)
-
-		for _, flow := range state.FlowStats.Flows {
-			if flow == nil {
-				continue
-			}
-
-			src := flow.Src
-			dst := flow.Dst
-			direction := string(flow.Direction)
-			flowType := string(flow.Type)
-			if src == "" || dst == "" {
-				continue
-			}
-
-			flowLast2.WithLabelValues(interfaceName, src, dst, direction, flowType, owner).Set(flow.Last2RateBits)
-			flowLast10.WithLabelValues(interfaceName, src, dst, direction, flowType, owner).Set(flow.Last10RateBits)
-			flowLast40.WithLabelValues(interfaceName, src, dst, direction, flowType, owner).Set(flow.Last40RateBits)
-			flowCumulative.WithLabelValues(interfaceName, src, dst, direction, flowType, owner).Set(flow.CumulativeBytes)
+		if staleness := mgr.staleness(); staleness > 0 && now.Sub(state.RoundEnd) > staleness {
+			mgr.Debugf("collect metrics: interface (%s) dropped, the latest round ended at (%s)", interfaceName, state.RoundEnd)
+			continue
 		}
 
-		totalLast2.WithLabelValues(interfaceName, out, owner).Set(state.FlowStats.TotalSentLast2RateBits)
-		totalLast2.WithLabelValues(interfaceName, in, owner).Set(state.FlowStats.TotalRecvLast2RateBits)
-		totalLast2.WithLabelValues(interfaceName, x, owner).Set(state.FlowStats.TotalSentAndRecvLast2RateBits)
+		state = mgr.ownerState(interfaceName, state)
+		states[interfaceName] = state
+		samples[interfaceName] = aggregateFlows(state.FlowStats.Flows, mgr.portLabels, mgr.peers)
+	}
 
-		totalLast10.WithLabelValues(interfaceName, out, owner).Set(state.FlowStats.TotalSentLast10RateBits)
-		totalLast10.WithLabelValues(interfaceName, in, owner).Set(state.FlowStats.TotalRecvLast10RateBits)
-		totalLast10.WithLabelValues(interfaceName, x, owner).Set(state.FlowStats.TotalSentAndRecvLast10RateBits)
+	// the limits are applied to all interfaces together, as they share the max series budget
+	limited := mgr.flowLimits.limitFlows(samples)
+	for interfaceName, state := range states {
+		c.collectState(ch, interfaceName, state, limited[interfaceName])
+	}
+}
 
-		totalLast40.WithLabelValues(interfaceName, out, owner).Set(state.FlowStats.TotalSentLast40RateBits)
-		totalLast40.WithLabelValues(interfaceName, in, owner).Set(state.FlowStats.TotalRecvLast40RateBits)
-		totalLast40.WithLabelValues(interfaceName, x, owner).Set(state.FlowStats.TotalSentAndRecvLast40RateBits)
+// collectState sends the metrics of the snapshot of an interface.
+func (c *Collector) collectState(ch chan<- prometheus.Metric, interfaceName string, state iftop.State, flows *limitedFlows) {
+	mgr := c.mgr
+	d := c.descs
+	out := string(iftop.FlowDirectionOut)
+	in := string(iftop.FlowDirectionIn)
+	x := string(iftop.FlowDirectionX)
+	infoValues := mgr.infoLabelValues(interfaceName)
+	flowStats := state.FlowStats
 
-		peak.WithLabelValues(interfaceName, out, owner).Set(state.FlowStats.PeakSentRateBits)
-		peak.WithLabelValues(interfaceName, in, owner).Set(state.FlowStats.PeakRecvRateBits)
-		peak.WithLabelValues(interfaceName, x, owner).Set(state.FlowStats.PeakSentAndRecvRateBits)
+	gauge := func(desc *prometheus.Desc, value float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append(labelValues, infoValues...)...)
+	}
+	counter := func(desc *prometheus.Desc, value float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, append(labelValues, infoValues...)...)
+	}
+
+	mgr.Debugf("collect metrics: (%d) flows for interface (%s)", len(flowStats.Flows), interfaceName)
+
+	for _, sample := range flows.samples {
+		labelValues := []string{interfaceName, sample.src, sample.dst, sample.direction, sample.srcZone, sample.dstZone, sample.srcPort, sample.dstPort, sample.peerOwner, sample.peerKind}
+		gauge(d.flowLast2, sample.last2, labelValues...)
+		gauge(d.flowLast10, sample.last10, labelValues...)
+		gauge(d.flowLast40, sample.last40, labelValues...)
+		gauge(d.flowCumulative, sample.cumulative, labelValues...)
+	}
+
+	gauge(d.totalLast2, flowStats.TotalSentLast2RateBits, interfaceName, out)
+	gauge(d.totalLast2, flowStats.TotalRecvLast2RateBits, interfaceName, in)
+	gauge(d.totalLast2, flowStats.TotalSentAndRecvLast2RateBits, interfaceName, x)
+
+	gauge(d.totalLast10, flowStats.TotalSentLast10RateBits, interfaceName, out)
+	gauge(d.totalLast10, flowStats.TotalRecvLast10RateBits, interfaceName, in)
+	gauge(d.totalLast10, flowStats.TotalSentAndRecvLast10RateBits, interfaceName, x)
+
+	gauge(d.totalLast40, flowStats.TotalSentLast40RateBits, interfaceName, out)
+	gauge(d.totalLast40, flowStats.TotalRecvLast40RateBits, interfaceName, in)
+	gauge(d.totalLast40, flowStats.TotalSentAndRecvLast40RateBits, interfaceName, x)
+
+	gauge(d.peak, flowStats.PeakSentRateBits, interfaceName, out)
+	gauge(d.peak, flowStats.PeakRecvRateBits, interfaceName, in)
+	gauge(d.peak, flowStats.PeakSentAndRecvRateBits, interfaceName, x)
+
+	gauge(d.cumulative, flowStats.CumulativeSentBytes, interfaceName, out)
+	gauge(d.cumulative, flowStats.CumulativeRecvBytes, interfaceName, in)
+	gauge(d.cumulative, flowStats.CumulativeSentAndRecvBytes, interfaceName, x)
 
-		cumulative.WithLabelValues(interfaceName, out, owner).Set(state.FlowStats.CumulativeSentBytes)
-		cumulative.WithLabelValues(interfaceName, in, owner).Set(state.FlowStats.CumulativeRecvBytes)
-		cumulative.WithLabelValues(interfaceName, x, owner).Set(state.FlowStats.CumulativeSentAndRecvBytes)
+	for _, reason := range []string{FoldReasonTopK, FoldReasonMaxSeries} {
+		gauge(d.foldedFlows, float64(flows.folded[reason]), interfaceName, reason)
 	}
+
+	if !state.RoundEnd.IsZero() {
+		gauge(d.lastUpdate, float64(state.RoundEnd.UnixNano())/1e9, interfaceName)
+	}
+
+	if coverage, ok := mgr.counters.coverage(interfaceName); ok && coverage > 0 {
+		gauge(d.samplingCoverage, coverage, interfaceName)
+		gauge(d.estimatedCumulative, flowStats.CumulativeSentBytes/coverage, interfaceName, out)
+		gauge(d.estimatedCumulative, flowStats.CumulativeRecvBytes/coverage, interfaceName, in)
+		gauge(d.estimatedCumulative, flowStats.CumulativeSentAndRecvBytes/coverage, interfaceName, x)
+	}
+
+	if totals, ok := mgr.counters.totalsOf(interfaceName); ok {
+		counter(d.bytesTotal, totals.sent, interfaceName, out)
+		counter(d.bytesTotal, totals.recv, interfaceName, in)
+		counter(d.estimatedBytesTotal, totals.estimatedSent, interfaceName, out)
+		counter(d.estimatedBytesTotal, totals.estimatedRecv, interfaceName, in)
+
+		for key, total := range totals.flows {
+			counter(d.flowBytesTotal, total.bytes,
+				interfaceName, key.src, key.dst, string(key.direction), key.srcZone, key.dstZone, key.srcPort, key.dstPort, total.peerOwner, total.peerKind)
+		}
+	}
+}
+
+// infoLabelValues returns the values of the info labels of the interface, in the order of the info labels.
+// The missing keys (and all keys of the static interfaces) have empty values.
+func (mgr *Manager) infoLabelValues(interfaceName string) []string {
+	interfaceInfo := mgr.interfaceInfo(interfaceName)
+	values := make([]string, 0, len(mgr.infoLabels))
+	for _, infoLabel := range mgr.infoLabels {
+		values = append(values, interfaceInfo[infoLabel.Key])
+	}
+	return values
+}
+
+// accumulate adds the bytes of the round in state to the monotonic counters, and the progress of the run to the self metrics,
+// it is safe to call it repeatedly with the same state. The state is the raw one of the source, see ownerState.
+func (mgr *Manager) accumulate(interfaceName string, state iftop.State) {
+	mgr.counters.observe(interfaceName, mgr.ownerState(interfaceName, state))
+	mgr.progress.observe(interfaceName, state)
+}
+
+// flowSample holds the metric values of the flows which have the same labels.
+type flowSample struct {
+	src        string
+	dst        string
+	direction  string
+	srcZone    string
+	dstZone    string
+	srcPort    string
+	dstPort    string
+	peerOwner  string
+	peerKind   string
+	last2      float64
+	last10     float64
+	last40     float64
+	cumulative float64
+}
+
+// aggregateFlows sums up the flows which have the same labels, as a const metric must be unique,
+// e.g. the flows from the ephemeral ports to the same peer port.
+func aggregateFlows(flows []*iftop.Flow, portLabels PortLabels, peers *peerIndex) []*flowSample {
+	samples := []*flowSample{}
+	index := map[string]*flowSample{}
+
+	for _, flow := range flows {
+		if flow == nil || flow.Src == "" || flow.Dst == "" {
+			continue
+		}
+
+		sample := &flowSample{
+			src:       flow.Src,
+			dst:       flow.Dst,
+			direction: string(flow.Direction),
+			srcZone:   flow.SrcZone,
+			dstZone:   flow.DstZone,
+			srcPort:   portLabels.label(flow.SrcPort),
+			dstPort:   portLabels.label(flow.DstPort),
+		}
+		if flow.Src != "all" {
+			sample.peerOwner, sample.peerKind = peers.labels(flow)
+		}
+		key := strings.Join([]string{sample.src, sample.dst, sample.direction, sample.srcZone, sample.dstZone, sample.srcPort, sample.dstPort,
+			sample.peerOwner, sample.peerKind}, "\xff")
+		if existing, ok := index[key]; ok {
+			sample = existing
+		} else {
+			index[key] = sample
+			samples = append(samples, sample)
+		}
+
+		sample.last2 += flow.Last2RateBits
+		sample.last10 += flow.Last10RateBits
+		sample.last40 += flow.Last40RateBits
+		sample.cumulative += flow.CumulativeBytes
+	}
+
+	return samples
 }
@@ -0,0 +1,102 @@
+package manager
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	mgr.WithStaleAfter(time.Minute)
+
+	now := time.Now()
+	fresh := newFakeSource("eth0", 0)
+	fresh.state = iftop.State{
+		Interface: "eth0",
+		FlowStats: &iftop.FlowStats{
+			Flows: []*iftop.Flow{
+				// the same labels twice, e.g. the same peer on two ports, are summed up
+				newOutFlow("10.0.0.2", 100),
+				newOutFlow("10.0.0.2", 50),
+			},
+			CumulativeSentBytes: 150,
+		},
+		Round:    1,
+		RunStart: now.Add(-2 * time.Second),
+		RoundEnd: now,
+	}
+
+	stale := newFakeSource("eth1", 0)
+	stale.state = fresh.state
+	stale.state.Interface = "eth1"
+	stale.state.RoundEnd = now.Add(-2 * time.Minute)
+
+	mgr.tasks["eth0"] = fresh
+	mgr.tasks["eth1"] = stale
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(mgr.Collector())
+
+	expected := `
+# HELP iftop_flow_cumulative_bytes cumulative bytes of the flow
+# TYPE iftop_flow_cumulative_bytes gauge
+iftop_flow_cumulative_bytes{direction="out",dst="10.0.0.2",dst_port="",dst_zone="private",interface="eth0",owner="",peer_kind="",peer_owner="",src="10.0.0.1",src_port="",src_zone="private"} 150
+# HELP iftop_bytes_total total bytes of all flows observed by iftop runs, it survives iftop restarts, the traffic between runs is not observed
+# TYPE iftop_bytes_total counter
+iftop_bytes_total{direction="in",interface="eth0",owner=""} 0
+iftop_bytes_total{direction="out",interface="eth0",owner=""} 150
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"iftop_flow_cumulative_bytes", "iftop_bytes_total"))
+
+	// the stale interface is dropped, the fresh one has its last update timestamp
+	count, err := testutil.GatherAndCount(registry, "iftop_last_update_timestamp_seconds")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// a scrape never sees an interface without a completed round
+	mgr.tasks["eth2"] = newFakeSource("eth2", 0)
+	count, err = testutil.GatherAndCount(registry, "iftop_cumulative_bytes")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestCollectorInfoLabels(t *testing.T) {
+	mgr, err := NewManager(nil, true, "")
+	assert.NoError(t, err)
+	infoLabels, err := ParseInfoLabels("owner,namespace,labels.app=app")
+	assert.NoError(t, err)
+	mgr.WithInfoLabels(infoLabels)
+
+	source := newFakeSource("veth0", 0)
+	source.state.Round = 1
+	source.state.RoundEnd = time.Now()
+	source.state.FlowStats.Flows = []*iftop.Flow{newOutFlow("10.0.0.2", 100)}
+	mgr.tasks["veth0"] = source
+	mgr.dynamicInterfaceInfo["veth0"] = map[string]string{
+		"owner":      "default/nginx-0",
+		"namespace":  "default",
+		"labels.app": "nginx",
+	}
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(mgr.Collector())
+
+	expected := `
+# HELP iftop_flow_cumulative_bytes cumulative bytes of the flow
+# TYPE iftop_flow_cumulative_bytes gauge
+iftop_flow_cumulative_bytes{app="nginx",direction="out",dst="10.0.0.2",dst_port="",dst_zone="private",interface="veth0",namespace="default",owner="default/nginx-0",peer_kind="",peer_owner="",src="10.0.0.1",src_port="",src_zone="private"} 100
+# HELP iftop_sampling_coverage_ratio the ratio of the time observed by iftop runs to the wall time, 1 means no traffic is missed
+# TYPE iftop_sampling_coverage_ratio gauge
+iftop_sampling_coverage_ratio{app="nginx",interface="veth0",namespace="default",owner="default/nginx-0"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"iftop_flow_cumulative_bytes", "iftop_sampling_coverage_ratio"))
+}
@@ -0,0 +1,141 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+)
+
+// PeerIndexFile is the name of the peer index file written by the helper into the dynamic dir.
+const PeerIndexFile = ".peers.json"
+
+// PeerIndexVersion is the latest version of the peer index file.
+const PeerIndexVersion = 1
+
+// The peer kinds of the dst which is not in the peer index, the peer_owner label is the same as the peer_kind label.
+const (
+	// PeerExternal is the peer of the dst in the default zone, which is outside of the cluster, see iftop.Zones.
+	PeerExternal = "external"
+	// PeerUnknown is the peer of the other dst, e.g. the nodes, or the pods not indexed yet.
+	PeerUnknown = "unknown"
+)
+
+// peer is the owner of an IP in the peer index file, e.g. {"kind": "service", "owner": "default/postgres"}.
+type peer struct {
+	Kind  string `json:"kind"`
+	Owner string `json:"owner"`
+}
+
+type peerIndexFile struct {
+	Version int             `json:"version"`
+	Peers   map[string]peer `json:"peers"`
+}
+
+// peerIndex resolves the dst of the flows to their peers.
+type peerIndex struct {
+	lock  sync.RWMutex
+	peers map[netip.Addr]peer
+	// defaultZone is the zone of the dst whose peer is PeerExternal.
+	defaultZone string
+}
+
+// parsePeerIndex parses the peer index file.
+func parsePeerIndex(b []byte) (map[netip.Addr]peer, error) {
+	file := peerIndexFile{}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+
+	if file.Version < 0 || file.Version > PeerIndexVersion {
+		return nil, fmt.Errorf("unsupported version (%d), the latest supported version is (%d)", file.Version, PeerIndexVersion)
+	}
+
+	peers := make(map[netip.Addr]peer, len(file.Peers))
+	for ip, p := range file.Peers {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip (%s), err: %s", ip, err)
+		}
+		peers[addr.Unmap()] = p
+	}
+	return peers, nil
+}
+
+// WithPeers resolves the dst of the flows to the pods and the services by the peer index file in the dynamic dir,
+// they are exported as the peer_owner and peer_kind labels, see PeerExternal and PeerUnknown for the dst not in the index.
+func (mgr *Manager) WithPeers(peers bool) error {
+	if !peers {
+		mgr.peers = nil
+		mgr.counters.peers = nil
+		return nil
+	}
+	if !mgr.dynamic {
+		return fmt.Errorf("peers need the dynamic mode, the peer index file is written into the dynamic dir")
+	}
+
+	mgr.peers = &peerIndex{defaultZone: mgr.zones.DefaultZone()}
+	mgr.counters.peers = mgr.peers
+	return nil
+}
+
+// loadPeers reloads the peer index file, an invalid file is ignored, the loaded index is kept.
+// A missing file empties the index.
+func (mgr *Manager) loadPeers() {
+	if mgr.peers == nil {
+		return
+	}
+
+	fileName := filepath.Join(mgr.dynamicDir, PeerIndexFile)
+	b, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		mgr.Debugf("peer index file (%s) not found", fileName)
+		mgr.peers.set(nil)
+		return
+	}
+	if err != nil {
+		log.Printf("read peer index file (%s) failed, err: %s", fileName, err)
+		return
+	}
+
+	peers, err := parsePeerIndex(b)
+	if err != nil {
+		log.Printf("parse peer index file (%s) failed, err: %s", fileName, err)
+		return
+	}
+	mgr.peers.set(peers)
+	mgr.Debugf("load peer index file (%s) succeeded, (%d) peers", fileName, len(peers))
+}
+
+func (p *peerIndex) set(peers map[netip.Addr]peer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.peers = peers
+}
+
+// labels returns the peer_owner and peer_kind labels of the flow, which are empty if the peers are disabled.
+// The dst is the remote end of the flows of both directions.
+func (p *peerIndex) labels(flow *iftop.Flow) (owner string, kind string) {
+	if p == nil {
+		return "", ""
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	if addr, err := netip.ParseAddr(flow.Dst); err == nil {
+		if peer, ok := p.peers[addr.WithZone("").Unmap()]; ok {
+			return peer.Owner, peer.Kind
+		}
+	}
+
+	if flow.DstZone == p.defaultZone {
+		return PeerExternal, PeerExternal
+	}
+	return PeerUnknown, PeerUnknown
+}
@@ -0,0 +1,95 @@
+package manager
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePeerIndex(t *testing.T) {
+	peers, err := parsePeerIndex([]byte(`{"version": 1, "peers": {
+		"10.244.0.5": {"kind": "service", "owner": "default/db", "namespace": "default", "pod": "db-0"},
+		"fd00::20": {"kind": "service", "owner": "default/db"}
+	}}`))
+	assert.NoError(t, err)
+	assert.Len(t, peers, 2)
+
+	_, err = parsePeerIndex([]byte(`{"version": 2, "peers": {}}`))
+	assert.Error(t, err)
+
+	_, err = parsePeerIndex([]byte(`{"version": 1, "peers": {"db-0": {"kind": "pod", "owner": "default/db-0"}}}`))
+	assert.Error(t, err)
+}
+
+func TestPeerLabels(t *testing.T) {
+	peers, err := parsePeerIndex([]byte(`{"version": 1, "peers": {"10.244.0.5": {"kind": "pod", "owner": "default/web"}}}`))
+	assert.NoError(t, err)
+	index := &peerIndex{peers: peers, defaultZone: iftop.DefaultZone}
+
+	var tests = []struct {
+		dst           string
+		expectedOwner string
+		expectedKind  string
+	}{
+		{"10.244.0.5", "default/web", "pod"},
+		{"::ffff:10.244.0.5", "default/web", "pod"},
+		{"10.244.0.6", PeerUnknown, PeerUnknown},
+		{"8.8.8.8", PeerExternal, PeerExternal},
+		{"example.com", PeerUnknown, PeerUnknown},
+	}
+
+	for _, tt := range tests {
+		flow := &iftop.Flow{Src: "10.244.0.1", Dst: tt.dst}
+		iftop.DefaultZones.ClassifyFlow(flow)
+		owner, kind := index.labels(flow)
+		assert.Equal(t, tt.expectedOwner, owner, tt.dst)
+		assert.Equal(t, tt.expectedKind, kind, tt.dst)
+	}
+
+	// disabled
+	var disabled *peerIndex
+	owner, kind := disabled.labels(&iftop.Flow{Dst: "10.244.0.5"})
+	assert.Equal(t, "", owner)
+	assert.Equal(t, "", kind)
+}
+
+func TestCollectorPeers(t *testing.T) {
+	dir := t.TempDir()
+	mgr, err := NewManager(nil, true, dir)
+	assert.NoError(t, err)
+	assert.NoError(t, mgr.WithPeers(true))
+
+	err = os.WriteFile(filepath.Join(dir, PeerIndexFile),
+		[]byte(`{"version": 1, "peers": {"10.0.0.2": {"kind": "service", "owner": "default/db"}}}`), 0644)
+	assert.NoError(t, err)
+	mgr.loadPeers()
+
+	external := newOutFlow("8.8.8.8", 50)
+	external.DstZone = iftop.DefaultZone
+	source := newFakeSource("eth0", 0)
+	source.state = newRoundState(time.Now(), 1, 100, newOutFlow("10.0.0.2", 100), external)
+	mgr.tasks["eth0"] = source
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(mgr.Collector())
+
+	expected := `
+# HELP iftop_flow_cumulative_bytes cumulative bytes of the flow
+# TYPE iftop_flow_cumulative_bytes gauge
+iftop_flow_cumulative_bytes{direction="out",dst="10.0.0.2",dst_port="",dst_zone="private",interface="eth0",owner="",peer_kind="service",peer_owner="default/db",src="10.0.0.1",src_port="",src_zone="private"} 100
+iftop_flow_cumulative_bytes{direction="out",dst="8.8.8.8",dst_port="",dst_zone="public",interface="eth0",owner="",peer_kind="external",peer_owner="external",src="10.0.0.1",src_port="",src_zone="private"} 50
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), "iftop_flow_cumulative_bytes"))
+
+	// the peers are not resolved without the dynamic mode
+	mgr, err = NewManager([]string{"eth0"}, false, "")
+	assert.NoError(t, err)
+	assert.Error(t, mgr.WithPeers(true))
+}
@@ -0,0 +1,83 @@
+package manager
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultEphemeralPortMin is the lowest ephemeral port of Linux, see net.ipv4.ip_local_port_range.
+const DefaultEphemeralPortMin = 32768
+
+// EphemeralPort is the port label of the ephemeral ports.
+const EphemeralPort = "ephemeral"
+
+// PortLabels maps the ports of the flow ends to the src_port and dst_port labels.
+type PortLabels struct {
+	// EphemeralMin is the lowest ephemeral port, the ports from it are collapsed into EphemeralPort,
+	// so the client side of the connections does not blow up the cardinality, 0 means never.
+	EphemeralMin int
+	// Services names the ports, e.g. {"5432": "postgres"}, the other ports keep their numbers.
+	Services map[string]string
+}
+
+// ParsePortServices parses the comma separated port names, each item is `port=name`, e.g. "5432=postgres,6379=redis".
+func ParsePortServices(s string) (map[string]string, error) {
+	services := map[string]string{}
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		port, name, ok := strings.Cut(item, "=")
+		port, name = strings.TrimSpace(port), strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid port service (%s), must be port=name", item)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid port (%s) of service (%s), must be 1-65535", port, name)
+		}
+		if _, ok := services[port]; ok {
+			return nil, fmt.Errorf("duplicated port (%s)", port)
+		}
+		services[port] = name
+	}
+
+	return services, nil
+}
+
+func (p PortLabels) Valid() error {
+	if p.EphemeralMin < 0 || p.EphemeralMin > 65535 {
+		return fmt.Errorf("invalid ephemeral port min (%d), must be 0-65535", p.EphemeralMin)
+	}
+	return nil
+}
+
+// label returns the label value of the port, the empty port (no port shown) stays empty.
+// The port converted to a service by iftop (without -N) is kept as it is.
+func (p PortLabels) label(port string) string {
+	if port == "" {
+		return ""
+	}
+	if name, ok := p.Services[port]; ok {
+		return name
+	}
+	if n, err := strconv.Atoi(port); err == nil && p.EphemeralMin > 0 && n >= p.EphemeralMin {
+		return EphemeralPort
+	}
+	return port
+}
+
+// WithPorts enables the port mode, iftop runs with -P -N, and the ports of the flow ends
+// are exported as the src_port and dst_port labels, see PortLabels.
+func (mgr *Manager) WithPorts(portLabels PortLabels) error {
+	if err := portLabels.Valid(); err != nil {
+		return err
+	}
+	mgr.showPorts = true
+	mgr.portLabels = portLabels
+	mgr.counters.portLabels = portLabels
+	return nil
+}
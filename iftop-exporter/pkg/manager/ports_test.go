@@ -0,0 +1,68 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePortServices(t *testing.T) {
+	services, err := ParsePortServices("5432=postgres, 6379=redis,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"5432": "postgres", "6379": "redis"}, services)
+
+	for _, s := range []string{"postgres", "5432=", "0=zero", "http=80", "80=http,80=www"} {
+		_, err := ParsePortServices(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestPortLabels(t *testing.T) {
+	portLabels := PortLabels{EphemeralMin: DefaultEphemeralPortMin, Services: map[string]string{"5432": "postgres"}}
+
+	assert.Equal(t, "", portLabels.label(""))
+	assert.Equal(t, "443", portLabels.label("443"))
+	assert.Equal(t, "postgres", portLabels.label("5432"))
+	assert.Equal(t, EphemeralPort, portLabels.label("45678"))
+	assert.Equal(t, "http", portLabels.label("http"), "the services converted by iftop are kept")
+	assert.Equal(t, "45678", PortLabels{}.label("45678"), "the ports are never collapsed without EphemeralMin")
+}
+
+func TestAggregateFlowsPorts(t *testing.T) {
+	newFlow := func(srcPort string, cumulative float64) *iftop.Flow {
+		return &iftop.Flow{
+			Src: "10.0.0.1", SrcPort: srcPort, Dst: "10.0.0.2", DstPort: "443",
+			Direction: iftop.FlowDirectionOut, CumulativeBytes: cumulative,
+		}
+	}
+
+	samples := aggregateFlows([]*iftop.Flow{
+		newFlow("45678", 100),
+		newFlow("45679", 50),
+		newFlow("8080", 10),
+	}, PortLabels{EphemeralMin: DefaultEphemeralPortMin}, nil)
+
+	// the flows from the ephemeral ports are summed up
+	assert.Len(t, samples, 2)
+	assert.Equal(t, EphemeralPort, samples[0].srcPort)
+	assert.Equal(t, "443", samples[0].dstPort)
+	assert.Equal(t, 150.0, samples[0].cumulative)
+	assert.Equal(t, "8080", samples[1].srcPort)
+}
+
+func TestManagerWithPorts(t *testing.T) {
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+
+	options := mgr.captureOptions("eth0")
+	assert.False(t, options.ShowPort)
+	assert.False(t, options.NoPortConvert)
+
+	assert.Error(t, mgr.WithPorts(PortLabels{EphemeralMin: 70000}))
+	assert.NoError(t, mgr.WithPorts(PortLabels{EphemeralMin: 49152}))
+	options = mgr.captureOptions("eth0")
+	assert.True(t, options.ShowPort)
+	assert.True(t, options.NoPortConvert)
+	assert.Equal(t, 49152, mgr.counters.portLabels.EphemeralMin)
+}
@@ -0,0 +1,118 @@
+package manager
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// scheduler limits the number of the concurrent captures.
+//
+// The captures over the limit wait in a FIFO queue, an interface joins the tail again
+// after its run, so the interfaces take turns (round-robin) when the node has more interfaces than slots.
+type scheduler struct {
+	// maxConcurrent is the max number of the concurrent captures, 0 means unlimited.
+	maxConcurrent int
+
+	lock    sync.Mutex
+	running int
+	queue   []chan struct{}
+}
+
+func newScheduler(maxConcurrent int) *scheduler {
+	return &scheduler{maxConcurrent: maxConcurrent}
+}
+
+// acquire blocks until a slot is available or ctx is done, release must be called after the capture
+// if it returns nil.
+func (s *scheduler) acquire(ctx context.Context) error {
+	if s.maxConcurrent <= 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	if s.running < s.maxConcurrent && len(s.queue) == 0 {
+		s.running++
+		s.lock.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	s.queue = append(s.queue, ready)
+	capturesWaiting.Set(float64(len(s.queue)))
+	s.lock.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
+	for i, ch := range s.queue {
+		if ch == ready {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			capturesWaiting.Set(float64(len(s.queue)))
+			s.lock.Unlock()
+			return ctx.Err()
+		}
+	}
+	s.lock.Unlock()
+
+	// the slot was handed over in the meantime, pass it on
+	s.release()
+	return ctx.Err()
+}
+
+// release hands the slot over to the head of the queue, or frees it.
+func (s *scheduler) release() {
+	if s.maxConcurrent <= 0 {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.queue) > 0 {
+		ready := s.queue[0]
+		s.queue = s.queue[1:]
+		capturesWaiting.Set(float64(len(s.queue)))
+		close(ready)
+		return
+	}
+	s.running--
+}
+
+// WithMaxConcurrentCaptures limits the number of the concurrent captures, 0 means unlimited.
+// The captures over the limit wait for a slot in turn, so the effective interval of each interface grows.
+func (mgr *Manager) WithMaxConcurrentCaptures(maxConcurrent int) *Manager {
+	mgr.scheduler = newScheduler(maxConcurrent)
+	return mgr
+}
+
+// startOffset returns the delay of the first run of the interface, which spreads the periodic runs
+// of the interfaces across the interval, instead of starting all of them at the same instant.
+// The offset is derived from the interface name, so it is stable across restarts.
+func (mgr *Manager) startOffset(interfaceName string) time.Duration {
+	if mgr.continuous || mgr.interval <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(interfaceName))
+	return time.Duration(h.Sum64() % uint64(mgr.interval))
+}
+
+// observeRunStart updates the effective interval of the interface, which is the time between its latest run starts.
+func (mgr *Manager) observeRunStart(interfaceName string, start time.Time) {
+	mgr.lock.Lock()
+	defer mgr.lock.Unlock()
+
+	if _, ok := mgr.removeChs[interfaceName]; !ok {
+		return
+	}
+	if last, ok := mgr.runStarts[interfaceName]; ok {
+		effectiveInterval.WithLabelValues(interfaceName).Set(start.Sub(last).Seconds())
+	}
+	mgr.runStarts[interfaceName] = start
+}
@@ -0,0 +1,158 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/recorder"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler(2)
+
+	var running, maxRunning atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.acquire(context.Background()))
+			defer s.release()
+
+			n := running.Add(1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			running.Add(-1)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(2), maxRunning.Load())
+	assert.Equal(t, 0, s.running)
+	assert.Empty(t, s.queue)
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := newScheduler(1)
+	assert.NoError(t, s.acquire(context.Background()))
+
+	// the waiters get the slot in the order they joined the queue
+	order := make(chan int, 3)
+	for i := range 3 {
+		go func() {
+			assert.NoError(t, s.acquire(context.Background()))
+			order <- i
+			s.release()
+		}()
+		assert.Eventually(t, func() bool {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			return len(s.queue) == i+1
+		}, time.Second, time.Millisecond)
+	}
+
+	s.release()
+	for i := range 3 {
+		assert.Equal(t, i, <-order)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := newScheduler(1)
+	assert.NoError(t, s.acquire(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.acquire(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return len(s.queue) == 1
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+	assert.Empty(t, s.queue, "the cancelled waiter leaves the queue")
+
+	s.release()
+	assert.Equal(t, 0, s.running)
+
+	// unlimited
+	s = newScheduler(0)
+	for range 100 {
+		assert.NoError(t, s.acquire(context.Background()))
+	}
+}
+
+// TestManagerWaitingRecorder removes an interface while its run waits for a slot,
+// the run never starts, so it must not leave a recorded run behind.
+func TestManagerWaitingRecorder(t *testing.T) {
+	recordDir := t.TempDir()
+	outputRecorder, err := recorder.NewRecorder(recordDir, 0, 0)
+	assert.NoError(t, err)
+
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(true, 100*time.Millisecond, 0)
+	mgr.WithMaxConcurrentCaptures(1)
+	mgr.WithRecorder(outputRecorder)
+	// the only slot is taken
+	assert.NoError(t, mgr.scheduler.acquire(context.Background()))
+
+	done := make(chan struct{})
+	go func() {
+		mgr.exec("eth0")
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		mgr.lock.Lock()
+		defer mgr.lock.Unlock()
+		return mgr.taskStates["eth0"] == TaskStateWaiting
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mgr.stop("eth0")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exec did not return after stop")
+	}
+
+	// no run is created, so no run is left active (never rotated)
+	entries, err := os.ReadDir(recordDir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStartOffset(t *testing.T) {
+	mgr, err := NewManager(nil, false, "")
+	assert.NoError(t, err)
+	mgr.WithContinuous(false, 10*time.Second, 3*time.Second)
+
+	offsets := map[time.Duration]bool{}
+	for i := range 100 {
+		interfaceName := fmt.Sprintf("veth%d", i)
+		offset := mgr.startOffset(interfaceName)
+		assert.GreaterOrEqual(t, offset, time.Duration(0))
+		assert.Less(t, offset, 10*time.Second)
+		assert.Equal(t, offset, mgr.startOffset(interfaceName), "stable for the same interface")
+		offsets[offset] = true
+	}
+	assert.Greater(t, len(offsets), 90, "the offsets are spread across the interval")
+
+	mgr.WithContinuous(true, 0, 0)
+	assert.Equal(t, time.Duration(0), mgr.startOffset("veth0"))
+}
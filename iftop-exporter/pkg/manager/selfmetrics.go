@@ -0,0 +1,167 @@
+package manager
+
+import (
+	"errors"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The metrics of the exporter itself, they tell whether the tasks are producing data.
+var (
+	runsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iftop_exporter_runs_started_total",
+		Help: "the number of the started runs of the tasks",
+	}, []string{"interface"})
+
+	runsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iftop_exporter_runs_completed_total",
+		Help: "the number of the runs which exited without error",
+	}, []string{"interface"})
+
+	runsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iftop_exporter_runs_failed_total",
+		Help: "the number of the runs which exited with error, by the reason recognised from the error",
+	}, []string{"interface", "reason"})
+
+	runExits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iftop_exporter_run_exits_total",
+		Help: "the number of the exited runs by the exit code, -1 means killed by signal or not started",
+	}, []string{"interface", "code"})
+
+	runDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "iftop_exporter_run_duration_seconds",
+		Help:    "the duration of the runs",
+		Buckets: []float64{1, 2, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"interface"})
+
+	restarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iftop_exporter_restarts_total",
+		Help: "the number of the runs started after the first run of the task",
+	}, []string{"interface"})
+
+	unmatchedLines = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iftop_exporter_unmatched_lines_total",
+		Help: "the number of the iftop output lines which could not be parsed",
+	}, []string{"interface"})
+
+	roundsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iftop_exporter_rounds_total",
+		Help: "the number of the completed rounds, a round is a complete output of the flows",
+	}, []string{"interface"})
+
+	taskState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iftop_exporter_task_state",
+		Help: "the state of the task, 1 for the current state, the states are running, waiting, backing_off and parked",
+	}, []string{"interface", "state"})
+
+	effectiveInterval = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iftop_exporter_effective_interval_seconds",
+		Help: "the time between the latest two run starts of the task, it grows beyond interval+duration if the captures wait for a slot",
+	}, []string{"interface"})
+
+	capturesWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "iftop_exporter_captures_waiting",
+		Help: "the number of the captures waiting for a slot, see -max-concurrent-captures",
+	})
+
+	activeTasks = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "iftop_exporter_active_tasks",
+		Help: "the number of the tasks which have a source",
+	})
+
+	buildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iftop_exporter_build_info",
+		Help: "the build information of the exporter, the value is always 1",
+	}, []string{"version", "commit", "build_at", "goversion"})
+)
+
+func init() {
+	buildInfo.WithLabelValues(version.Version, version.Commit, version.BuildAt, runtime.Version()).Set(1)
+}
+
+// observeRun updates the run metrics after a run exited.
+func observeRun(interfaceName string, duration time.Duration, err error) {
+	code := 0
+	if err != nil {
+		code = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.ExitCode()
+		}
+		runsFailed.WithLabelValues(interfaceName, iftop.ErrorReason(err)).Inc()
+	} else {
+		runsCompleted.WithLabelValues(interfaceName).Inc()
+	}
+
+	runExits.WithLabelValues(interfaceName, strconv.Itoa(code)).Inc()
+	runDuration.WithLabelValues(interfaceName).Observe(duration.Seconds())
+}
+
+// deleteSelfMetrics drops the metrics of the removed interface.
+func deleteSelfMetrics(interfaceName string) {
+	labels := prometheus.Labels{"interface": interfaceName}
+	runsStarted.DeletePartialMatch(labels)
+	runsCompleted.DeletePartialMatch(labels)
+	runsFailed.DeletePartialMatch(labels)
+	runExits.DeletePartialMatch(labels)
+	runDuration.DeletePartialMatch(labels)
+	restarts.DeletePartialMatch(labels)
+	unmatchedLines.DeletePartialMatch(labels)
+	roundsCompleted.DeletePartialMatch(labels)
+	taskState.DeletePartialMatch(labels)
+	effectiveInterval.DeletePartialMatch(labels)
+}
+
+// runProgress turns the per run counts of the snapshots into the deltas of the self metrics,
+// like byteCounters does for the bytes.
+type runProgress struct {
+	lock sync.Mutex
+	runs map[string]*progress // key is interfaceName
+}
+
+type progress struct {
+	runStart       time.Time
+	round          uint64
+	unmatchedLines uint64
+}
+
+func newRunProgress() *runProgress {
+	return &runProgress{
+		runs: make(map[string]*progress),
+	}
+}
+
+// observe adds the rounds and the unmatched lines since the last observed snapshot of the run.
+func (p *runProgress) observe(interfaceName string, state iftop.State) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	last, ok := p.runs[interfaceName]
+	if !ok || !last.runStart.Equal(state.RunStart) {
+		last = &progress{runStart: state.RunStart}
+		p.runs[interfaceName] = last
+	}
+
+	if state.Round > last.round {
+		roundsCompleted.WithLabelValues(interfaceName).Add(float64(state.Round - last.round))
+		last.round = state.Round
+	}
+	if state.UnmatchedLines > last.unmatchedLines {
+		unmatchedLines.WithLabelValues(interfaceName).Add(float64(state.UnmatchedLines - last.unmatchedLines))
+		last.unmatchedLines = state.UnmatchedLines
+	}
+}
+
+func (p *runProgress) forget(interfaceName string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.runs, interfaceName)
+}
@@ -0,0 +1,50 @@
+package manager
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunProgress(t *testing.T) {
+	p := newRunProgress()
+	run1 := time.Now()
+
+	p.observe("self0", iftop.State{RunStart: run1, Round: 2, UnmatchedLines: 3})
+	p.observe("self0", iftop.State{RunStart: run1, Round: 2, UnmatchedLines: 3})
+	p.observe("self0", iftop.State{RunStart: run1, Round: 5, UnmatchedLines: 4})
+	assert.Equal(t, 5.0, testutil.ToFloat64(roundsCompleted.WithLabelValues("self0")))
+	assert.Equal(t, 4.0, testutil.ToFloat64(unmatchedLines.WithLabelValues("self0")))
+
+	// a new run counts from zero
+	p.observe("self0", iftop.State{RunStart: run1.Add(time.Minute), Round: 1, UnmatchedLines: 1})
+	assert.Equal(t, 6.0, testutil.ToFloat64(roundsCompleted.WithLabelValues("self0")))
+	assert.Equal(t, 5.0, testutil.ToFloat64(unmatchedLines.WithLabelValues("self0")))
+
+	deleteSelfMetrics("self0")
+	assert.Equal(t, 0.0, testutil.ToFloat64(roundsCompleted.WithLabelValues("self0")))
+}
+
+func TestObserveRun(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 3").Run()
+	assert.Error(t, exitErr)
+
+	observeRun("self1", time.Second, nil)
+	observeRun("self1", time.Second, exitErr)
+	observeRun("self1", time.Second, errors.New("not started"))
+	observeRun("self1", time.Second, &iftop.RunError{Kind: iftop.ErrInterfaceNotFound, Err: exitErr})
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(runsCompleted.WithLabelValues("self1")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(runsFailed.WithLabelValues("self1", iftop.ReasonUnknown)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(runsFailed.WithLabelValues("self1", iftop.ReasonInterfaceNotFound)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(runExits.WithLabelValues("self1", "0")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(runExits.WithLabelValues("self1", "3")), "the exit code is unwrapped from RunError")
+	assert.Equal(t, 1.0, testutil.ToFloat64(runExits.WithLabelValues("self1", "-1")))
+
+	deleteSelfMetrics("self1")
+}
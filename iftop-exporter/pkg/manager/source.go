@@ -0,0 +1,41 @@
+package manager
+
+import (
+	"context"
+
+	"github.com/bougou/iftop-exporter/iftop-exporter/pkg/iftop"
+)
+
+const (
+	// BackendIftop runs `stdbuf -oL iftop` for each capture and parses its text output.
+	BackendIftop = "iftop"
+
+	// BackendAFPacket captures packets from an AF_PACKET socket in Go,
+	// which gives full precision values and needs no child process.
+	BackendAFPacket = "afpacket"
+)
+
+// FlowSource is a capture backend which produces iftop.State for a single interface.
+//
+// The Manager only schedules sources (start, wait, restart, stop) and reads their state,
+// it does not care how the flows are captured. The default implementation is iftop.Task,
+// which runs `stdbuf -oL iftop` and parses its text output.
+type FlowSource interface {
+	// ID returns the name of the interface the source captures on.
+	ID() string
+
+	// RunContext starts the capture and blocks until it exits.
+	// The capture is stopped when ctx is done.
+	RunContext(ctx context.Context) error
+
+	// Stop terminates the capture if it is running.
+	// It is safe to call Stop on a source which was never started or has already exited.
+	Stop() error
+
+	// State returns the latest flow stats produced by the source.
+	State() iftop.State
+}
+
+// FlowSourceFactory creates a new FlowSource for the specified interface.
+// The Manager calls it for every run, so each returned source is only run once.
+type FlowSourceFactory func(interfaceName string) FlowSource
@@ -0,0 +1,128 @@
+package recorder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// defaultDownloadRuns is the number of runs downloaded when `runs` is not specified.
+const defaultDownloadRuns = 5
+
+// Handler serves the records.
+//
+//   - GET {path}                          lists the recorded runs of each interface in JSON.
+//   - GET {path}?interface=eth0&runs=3    downloads the last 3 runs of eth0 as a tar.gz.
+func (r *Recorder) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		interfaceName := req.URL.Query().Get("interface")
+		if interfaceName == "" {
+			r.serveList(w)
+			return
+		}
+
+		if !validInterfaceName(interfaceName) {
+			http.Error(w, fmt.Sprintf("invalid interface name (%s)", interfaceName), http.StatusBadRequest)
+			return
+		}
+
+		n := defaultDownloadRuns
+		if v := req.URL.Query().Get("runs"); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil || i <= 0 {
+				http.Error(w, fmt.Sprintf("invalid runs (%s)", v), http.StatusBadRequest)
+				return
+			}
+			n = i
+		}
+
+		r.serveDownload(w, interfaceName, n)
+	})
+}
+
+func (r *Recorder) serveList(w http.ResponseWriter) {
+	r.lock.Lock()
+	runs, err := r.runs("")
+	r.lock.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list records failed, err: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	result := map[string][]string{}
+	for _, run := range runs {
+		result[run.interfaceName] = append(result[run.interfaceName], run.id)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(result)
+}
+
+func (r *Recorder) serveDownload(w http.ResponseWriter, interfaceName string, n int) {
+	r.lock.Lock()
+	runs, err := r.runs(interfaceName)
+	r.lock.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("list records failed, err: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	if len(runs) == 0 {
+		http.Error(w, fmt.Sprintf("no records found for interface (%s)", interfaceName), http.StatusNotFound)
+		return
+	}
+
+	if len(runs) > n {
+		runs = runs[len(runs)-n:]
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "records-"+interfaceName+".tar.gz"))
+
+	gw := gzip.NewWriter(w)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	for _, run := range runs {
+		for _, suffix := range []string{stdoutSuffix, stderrSuffix} {
+			name := interfaceName + suffix
+			// the run may be rotated in the meantime, skip it silently
+			_ = addTarFile(tw, filepath.Join(run.dir, name), filepath.Join(run.id, name))
+		}
+	}
+}
+
+func addTarFile(tw *tar.Writer, path string, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, f, info.Size())
+	return err
+}
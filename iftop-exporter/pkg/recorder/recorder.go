@@ -0,0 +1,302 @@
+// Package recorder records the raw stdout/stderr of each iftop run into a
+// size and age bounded directory, for post-mortem debugging.
+//
+// The layout of the directory is:
+//
+//	{dir}/{interface}/{runID}/{interface}.stdout
+//	{dir}/{interface}/{runID}/{interface}.stderr
+//
+// so any run directory can be used directly as the `-replay-dir` of the exporter.
+package recorder
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	stdoutSuffix = ".stdout"
+	stderrSuffix = ".stderr"
+
+	// runIDLayout makes the run directories sort in chronological order by name.
+	runIDLayout = "20060102T150405.000000000Z"
+)
+
+// Recorder creates the record files of each run and rotates the old ones.
+type Recorder struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	lock sync.Mutex
+	// active holds the directories of the runs which are still being written, they are never rotated.
+	active map[string]bool
+	// closed is the index of the closed runs on disk, oldest first. It is built by a scan at startup
+	// and kept up to date by Run.Close, so the rotation never walks the record dir.
+	closed      []runInfo
+	closedBytes int64
+}
+
+// NewRecorder creates a Recorder which keeps at most maxBytes of records under dir,
+// and removes the records older than maxAge. Zero maxBytes or maxAge means no bound.
+// The runs still being written are not counted until they are closed.
+func NewRecorder(dir string, maxBytes int64, maxAge time.Duration) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create record dir (%s) failed, err: %s", dir, err)
+	}
+
+	r := &Recorder{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		active:   make(map[string]bool),
+	}
+
+	runs, err := r.runs("")
+	if err != nil {
+		return nil, fmt.Errorf("list records in (%s) failed, err: %s", dir, err)
+	}
+	r.closed = runs
+	for _, run := range runs {
+		r.closedBytes += run.size
+	}
+	r.rotate()
+
+	return r, nil
+}
+
+// Run holds the record files of a single run of an interface.
+type Run struct {
+	recorder *Recorder
+	dir      string
+	stdout   *lockedFile
+	stderr   *lockedFile
+}
+
+// NewRun creates the record files for a new run of the interface.
+func (r *Recorder) NewRun(interfaceName string) (*Run, error) {
+	if !validInterfaceName(interfaceName) {
+		return nil, fmt.Errorf("invalid interface name (%s)", interfaceName)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	runDir := filepath.Join(r.dir, interfaceName, time.Now().UTC().Format(runIDLayout))
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		return nil, fmt.Errorf("create run dir (%s) failed, err: %s", runDir, err)
+	}
+
+	stdout, err := os.Create(filepath.Join(runDir, interfaceName+stdoutSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("create stdout record file failed, err: %s", err)
+	}
+
+	stderr, err := os.Create(filepath.Join(runDir, interfaceName+stderrSuffix))
+	if err != nil {
+		stdout.Close()
+		return nil, fmt.Errorf("create stderr record file failed, err: %s", err)
+	}
+
+	r.active[runDir] = true
+
+	return &Run{
+		recorder: r,
+		dir:      runDir,
+		stdout:   &lockedFile{file: stdout},
+		stderr:   &lockedFile{file: stderr},
+	}, nil
+}
+
+// Stdout returns the writer of the raw stdout, it is safe for concurrent use.
+func (run *Run) Stdout() io.Writer {
+	return run.stdout
+}
+
+// Stderr returns the writer of the raw stderr, it is safe for concurrent use.
+func (run *Run) Stderr() io.Writer {
+	return run.stderr
+}
+
+// Close closes the record files, adds the run to the index of the closed runs and rotates the records.
+func (run *Run) Close() error {
+	stdoutErr := run.stdout.Close()
+	stderrErr := run.stderr.Close()
+
+	info := runInfo{
+		interfaceName: filepath.Base(filepath.Dir(run.dir)),
+		id:            filepath.Base(run.dir),
+		dir:           run.dir,
+	}
+	info.size, info.modTime = dirUsage(run.dir)
+
+	r := run.recorder
+	r.lock.Lock()
+	if r.active[run.dir] {
+		delete(r.active, run.dir)
+		// the runs of the interfaces close in any order, keep the index sorted by id
+		i := sort.Search(len(r.closed), func(i int) bool { return r.closed[i].id > info.id })
+		r.closed = append(r.closed, runInfo{})
+		copy(r.closed[i+1:], r.closed[i:])
+		r.closed[i] = info
+		r.closedBytes += info.size
+	}
+	r.lock.Unlock()
+
+	r.rotate()
+
+	if stdoutErr != nil {
+		return stdoutErr
+	}
+	return stderrErr
+}
+
+// runInfo describes a recorded run on disk.
+type runInfo struct {
+	interfaceName string
+	id            string
+	dir           string
+	size          int64
+	modTime       time.Time
+}
+
+// runs returns the recorded runs of the interface (all interfaces if empty), oldest first.
+func (r *Recorder) runs(interfaceName string) ([]runInfo, error) {
+	interfaceNames := []string{interfaceName}
+	if interfaceName == "" {
+		entries, err := os.ReadDir(r.dir)
+		if err != nil {
+			return nil, err
+		}
+		interfaceNames = interfaceNames[:0]
+		for _, entry := range entries {
+			if entry.IsDir() {
+				interfaceNames = append(interfaceNames, entry.Name())
+			}
+		}
+	}
+
+	runs := []runInfo{}
+	for _, name := range interfaceNames {
+		entries, err := os.ReadDir(filepath.Join(r.dir, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+
+			run := runInfo{
+				interfaceName: name,
+				id:            entry.Name(),
+				dir:           filepath.Join(r.dir, name, entry.Name()),
+			}
+
+			run.size, run.modTime = dirUsage(run.dir)
+
+			runs = append(runs, run)
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].id < runs[j].id
+	})
+
+	return runs, nil
+}
+
+// dirUsage returns the total size and the latest modification time of the files in the run dir.
+func dirUsage(dir string) (size int64, modTime time.Time) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, time.Time{}
+	}
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		size += info.Size()
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return size, modTime
+}
+
+// rotate removes the closed runs which are older than maxAge,
+// then removes the oldest closed runs until their total size is under maxBytes.
+// The runs are taken out of the index under the lock, and removed from the disk after it is released.
+func (r *Recorder) rotate() {
+	r.lock.Lock()
+	now := time.Now()
+	kept := r.closed[:0]
+	removed := []runInfo{}
+	for _, run := range r.closed {
+		expired := r.maxAge > 0 && now.Sub(run.modTime) > r.maxAge
+		if expired {
+			removed = append(removed, run)
+			r.closedBytes -= run.size
+			continue
+		}
+		kept = append(kept, run)
+	}
+	for r.maxBytes > 0 && r.closedBytes > r.maxBytes && len(kept) > 0 {
+		removed = append(removed, kept[0])
+		r.closedBytes -= kept[0].size
+		kept = kept[1:]
+	}
+	r.closed = kept
+	r.lock.Unlock()
+
+	for _, run := range removed {
+		if err := os.RemoveAll(run.dir); err != nil {
+			log.Printf("remove record (%s) failed, err: %s", run.dir, err)
+		}
+	}
+}
+
+// lockedFile serializes the writes from the concurrent stdout/stderr goroutines.
+type lockedFile struct {
+	lock   sync.Mutex
+	file   *os.File
+	closed bool
+}
+
+func (f *lockedFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	return f.file.Write(p)
+}
+
+func (f *lockedFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	return f.file.Close()
+}
+
+// validInterfaceName prevents the interface name from escaping the record dir.
+func validInterfaceName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
@@ -0,0 +1,152 @@
+package recorder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func recordRun(t *testing.T, r *Recorder, interfaceName string, content string) *Run {
+	run, err := r.NewRun(interfaceName)
+	require.NoError(t, err)
+
+	// the stdout/stderr goroutines of a task write concurrently
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.WriteString(run.Stdout(), content)
+	}()
+	go func() {
+		defer wg.Done()
+		io.WriteString(run.Stderr(), "interface: "+interfaceName+"\n")
+	}()
+	wg.Wait()
+
+	require.NoError(t, run.Close())
+	// the run id has nanosecond resolution, make sure the next run sorts after this one
+	time.Sleep(time.Millisecond)
+	return run
+}
+
+func TestRecorderRotate(t *testing.T) {
+	dir := t.TempDir()
+
+	// each run is 100 bytes of stdout and 16 bytes of stderr
+	r, err := NewRecorder(dir, 250, 0)
+	require.NoError(t, err)
+
+	first := recordRun(t, r, "eth0", strings.Repeat("a", 100))
+	second := recordRun(t, r, "eth0", strings.Repeat("b", 100))
+	third := recordRun(t, r, "eth0", strings.Repeat("c", 100))
+
+	assert.NoDirExists(t, first.dir, "the oldest run should be rotated by size")
+	assert.DirExists(t, second.dir)
+	assert.DirExists(t, third.dir)
+
+	b, err := os.ReadFile(filepath.Join(third.dir, "eth0"+stdoutSuffix))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("c", 100), string(b))
+
+	// rotate by age, the age of the closed runs is taken from the index
+	r.lock.Lock()
+	for i := range r.closed {
+		r.closed[i].modTime = time.Now().Add(-2 * time.Hour)
+	}
+	r.lock.Unlock()
+	r.maxAge = time.Hour
+	fourth := recordRun(t, r, "eth0", "d")
+
+	assert.NoDirExists(t, second.dir)
+	assert.NoDirExists(t, third.dir)
+	assert.DirExists(t, fourth.dir)
+
+	_, err = r.NewRun("../eth0")
+	assert.Error(t, err)
+}
+
+func TestRecorderRotateAtStartup(t *testing.T) {
+	dir := t.TempDir()
+
+	r, err := NewRecorder(dir, 0, 0)
+	require.NoError(t, err)
+	first := recordRun(t, r, "eth0", strings.Repeat("a", 100))
+	second := recordRun(t, r, "eth1", strings.Repeat("b", 100))
+	third := recordRun(t, r, "eth0", strings.Repeat("c", 100))
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, suffix := range []string{stdoutSuffix, stderrSuffix} {
+		require.NoError(t, os.Chtimes(filepath.Join(first.dir, "eth0"+suffix), old, old))
+	}
+
+	// the records left by the previous process are scanned and rotated at startup
+	r, err = NewRecorder(dir, 150, time.Hour)
+	require.NoError(t, err)
+	assert.NoDirExists(t, first.dir, "the expired run should be rotated")
+	assert.NoDirExists(t, second.dir, "the oldest run should be rotated by size")
+	assert.DirExists(t, third.dir)
+	assert.Equal(t, int64(116), r.closedBytes)
+
+	// the runs closed later are rotated by the index, across the interfaces
+	fourth := recordRun(t, r, "eth1", strings.Repeat("d", 100))
+	assert.NoDirExists(t, third.dir)
+	assert.DirExists(t, fourth.dir)
+	assert.Len(t, r.closed, 1)
+}
+
+func TestRecorderHandler(t *testing.T) {
+	r, err := NewRecorder(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+
+	recordRun(t, r, "eth0", "run1\n")
+	recordRun(t, r, "eth0", "run2\n")
+	recordRun(t, r, "eth0", "run3\n")
+	recordRun(t, r, "eth1", "other\n")
+
+	server := httptest.NewServer(r.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?interface=eth0&runs=2")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	gr, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	tr := tar.NewReader(gr)
+
+	stdouts := []string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if strings.HasSuffix(header.Name, stdoutSuffix) {
+			b, _ := io.ReadAll(tr)
+			stdouts = append(stdouts, string(b))
+		}
+	}
+	assert.Equal(t, []string{"run2\n", "run3\n"}, stdouts)
+
+	resp, err = http.Get(server.URL + "?interface=..")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "?interface=eth9")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}